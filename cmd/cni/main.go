@@ -1,6 +1,7 @@
 package main
 
 import (
+	"log"
 	"net"
 
 	"github.com/containernetworking/cni/pkg/skel"
@@ -18,6 +19,7 @@ import (
 
 const (
 	pluginName = "simple-cni"
+	mtu        = 1500
 )
 
 func main() {
@@ -26,46 +28,80 @@ func main() {
 
 func setupIPAM(args *skel.CmdArgs) (*ipam.IPAM, *config.CNIConf, error) {
 	// 加载 CNI 配置
-	conf, err := config.LoadCNIConfig(args.StdinData)
+	conf, err := config.LoadCNIConfig(args.StdinData, args.Args)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	// 加载持久化存储
-	s, err := store.NewStore(conf.DataDir, conf.Name)
+	s, err := store.New(store.Options{
+		Kind:       conf.Store,
+		Dir:        conf.DataDir,
+		Network:    conf.Name,
+		Kubeconfig: conf.Kubeconfig,
+		Node:       conf.Node,
+		Owner:      conf.EnvArgs.PodRef(),
+	})
 	if err != nil {
 		return nil, nil, err
 	}
-	defer s.Close()
+
+	// 数据文件损坏时，从网桥与容器网络命名空间中找回仍在使用的 IP
+	if r, ok := s.(store.Recoverable); ok {
+		_, subnet, err := net.ParseCIDR(conf.Subnet)
+		if err != nil {
+			s.Close()
+			return nil, nil, err
+		}
+		r.SetRecoverFunc(func() ([]net.IP, error) {
+			return bridge.LiveIPs(conf.Bridge, subnet)
+		})
+	}
 
 	// 创建 IPAM
 	im, err := ipam.NewIPAM(conf, s)
 	if err != nil {
+		s.Close()
 		return nil, nil, err
 	}
 
 	return im, conf, nil
 }
 
-func cmdAdd(args *skel.CmdArgs) error {
+func cmdAdd(args *skel.CmdArgs) (err error) {
 	im, conf, err := setupIPAM(args)
 	if err != nil {
 		return err
 	}
+	defer im.Close()
 
-	// 获取网关并分配 IP 地址
-	gateway := im.Gateway()
-	podIP, err := im.AllocateIP(args.ContainerID, args.IfName)
+	// 解析容器请求的静态 IP 与 MAC
+	reqIP, err := conf.RequestedIP()
+	if err != nil {
+		return err
+	}
+	mac, err := conf.RequestedMAC()
 	if err != nil {
 		return err
 	}
 
-	// 创建并配置桥接设备，如果之前已经创建了，就使用创建好了的
-	mtu := 1500
-	br, err := bridge.CreateBridge(conf.Bridge, mtu, im.IPNet(gateway))
+	// 获取网关并分配 IP 地址
+	gateway := im.Gateway()
+	alloc := store.Allocation{ContainerID: args.ContainerID, IfName: args.IfName, Netns: args.Netns}
+	alloc.SetPod(conf.EnvArgs.PodRef())
+	podIP, err := im.AllocateIP(alloc, reqIP)
 	if err != nil {
 		return err
 	}
+	// ADD 失败后运行时不一定会调用 DEL，这里收回已经分配的 IP，避免泄漏
+	defer func() {
+		if err == nil {
+			return
+		}
+		if _, relErr := im.ReleaseIP(args.ContainerID, args.IfName, conf.EnvArgs.PodKey()); relErr != nil {
+			log.Printf("WARNING: failed to release IP %s after failed ADD: %v", podIP, relErr)
+		}
+	}()
 
 	// 获取容器的网络命名空间
 	netns, err := ns.GetNS(args.Netns)
@@ -74,52 +110,159 @@ func cmdAdd(args *skel.CmdArgs) error {
 	}
 	defer netns.Close()
 
-	// 创建并配置 veth
-	if err := bridge.SetupVeth(netns, br, mtu, args.IfName, im.IPNet(podIP), gateway); err != nil {
+	vethConf := newVethConf(conf, args, im.IPNet(podIP), gateway)
+	vethConf.MAC = mac
+	if vethConf.Routes, err = conf.ParseRoutes(); err != nil {
+		return err
+	}
+
+	contIf, err := setupInterface(netns, conf, im, vethConf)
+	if err != nil {
 		return err
 	}
 
 	result := &type100.Result{
+		Interfaces: []*type100.Interface{contIf},
 		IPs: []*type100.IPConfig{
 			{
-				Address: net.IPNet{IP: podIP, Mask: im.Mask()},
-				Gateway: gateway,
+				Interface: type100.Int(0),
+				Address:   *vethConf.PodIP,
+				Gateway:   gateway,
 			},
 		},
+		Routes: resultRoutes(conf, gateway, vethConf.Routes),
+		DNS:    conf.DNS,
 	}
 
 	return types.PrintResult(result, conf.CNIVersion)
 }
 
+// resultRoutes 返回 CNI 结果中的路由：容器内的默认路由加上网络配置中的路由
+func resultRoutes(conf *config.CNIConf, gateway net.IP, routes []*types.Route) []*types.Route {
+	for _, r := range routes {
+		if ones, _ := r.Dst.Mask.Size(); ones == 0 {
+			return routes
+		}
+	}
+
+	def := &types.Route{Dst: net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}, GW: gateway}
+	// ipvlan l3 模式下默认路由直接指向接口
+	if conf.Mode == config.ModeIPVlan && conf.IPVlanMode == config.IPVlanModeL3 {
+		def.GW = nil
+	}
+	return append([]*types.Route{def}, routes...)
+}
+
+// setupInterface 按接入方式创建容器接口：bridge 模式下创建网桥与 veth，l3 模式下只创建 veth，
+// macvlan/ipvlan 模式下创建宿主机网卡的子接口
+func setupInterface(netns ns.NetNS, conf *config.CNIConf, im *ipam.IPAM, vethConf *bridge.VethConf) (*type100.Interface, error) {
+	if sub := subIfConf(conf); sub != nil {
+		return bridge.SetupSubIf(netns, sub, vethConf)
+	}
+	if vethConf.L3 {
+		return bridge.SetupVeth(netns, nil, vethConf)
+	}
+
+	// 持有 store 的锁，DEL 不会在网桥创建之后、veth 接入之前删除网桥
+	var contIf *type100.Interface
+	err := im.WithLock(func() error {
+		// 创建并配置桥接设备，如果之前已经创建了，就使用创建好了的
+		br, err := bridge.CreateBridge(bridgeConf(conf, im))
+		if err != nil {
+			return err
+		}
+		// 创建并配置 veth
+		contIf, err = bridge.SetupVeth(netns, br, vethConf)
+		return err
+	})
+	return contIf, err
+}
+
 func cmdDel(args *skel.CmdArgs) error {
-	im, _, err := setupIPAM(args)
+	im, conf, err := setupIPAM(args)
 	if err != nil {
 		return err
 	}
+	defer im.Close()
 
 	// 释放 IP 地址
-	if err := im.ReleaseIP(args.ContainerID); err != nil {
+	ip, err := im.ReleaseIP(args.ContainerID, args.IfName, conf.EnvArgs.PodKey())
+	if err != nil {
+		return err
+	}
+
+	// 删除宿主机缓存的旧 MAC，IP 分配给新的容器后重新解析
+	if ip != nil && conf.Mode == config.ModeBridge {
+		gwLink := bridgeConf(conf, im).GatewayLink()
+		if err := bridge.FlushNeigh(gwLink, ip); err != nil {
+			log.Printf("WARNING: failed to flush neighbor %s on %s: %v", ip, gwLink, err)
+		}
+	}
+
+	if err := delInterface(args, conf); err != nil {
 		return err
 	}
 
+	// 最后一个端口被删除后，清理子网变化之前留下的网桥
+	if conf.BridgeTeardown && conf.Mode == config.ModeBridge {
+		removeStaleBridge(conf, im)
+	}
+	return nil
+}
+
+// removeStaleBridge 在持有 store 锁的情况下删除子网变化之前留下的、已经没有端口的网桥，失败时只打印警告
+func removeStaleBridge(conf *config.CNIConf, im *ipam.IPAM) {
+	// 与当前网关相同的地址不是过期的地址，网桥仍在使用
+	previous, err := conf.PreviousGatewayNet()
+	if err != nil || previous == nil || previous.IP.Equal(im.Gateway()) {
+		return
+	}
+	var deleted bool
+	err = im.WithLock(func() error {
+		deleted, err = bridge.RemoveStaleBridge(conf.Bridge, previous)
+		return err
+	})
+	if err != nil {
+		log.Printf("WARNING: failed to remove stale bridge %s: %v", conf.Bridge, err)
+	} else if deleted {
+		log.Printf("removed stale bridge %s", conf.Bridge)
+	}
+}
+
+// delInterface 按接入方式删除容器接口
+func delInterface(args *skel.CmdArgs, conf *config.CNIConf) error {
 	netns, err := ns.GetNS(args.Netns)
 	if err != nil {
+		// 网络命名空间已经被删除，其中的接口（包括 veth 的两端）也随之消失
+		if _, ok := err.(ns.NSPathNotExistErr); ok {
+			return nil
+		}
 		return err
 	}
 	defer netns.Close()
 
-	// 删除 veth
+	if sub := subIfConf(conf); sub != nil {
+		return bridge.DelSubIf(netns, sub.Kind, args.IfName)
+	}
+
+	// 宿主机端 veth 的名称是确定的，另一端确实在容器网络命名空间中时直接在宿主机上删除
+	deleted, err := bridge.DelHostVeth(netns, bridge.HostVethName(conf.VethPrefix, args.ContainerID, args.IfName))
+	if err != nil || deleted {
+		return err
+	}
+	// 旧版本创建的 veth 名称是随机的，同名的宿主机设备属于其他 Pod 时也一样，只能在容器网络命名空间中删除
 	return bridge.DelVeth(netns, args.IfName)
 }
 
 func cmdCheck(args *skel.CmdArgs) error {
-	im, _, err := setupIPAM(args)
+	im, conf, err := setupIPAM(args)
 	if err != nil {
 		return err
 	}
+	defer im.Close()
 
 	// 检查 IP 地址是否被分配
-	podIP, err := im.CheckIP(args.ContainerID)
+	podIP, err := im.CheckIP(args.ContainerID, args.IfName)
 	if err != nil {
 		return err
 	}
@@ -130,5 +273,77 @@ func cmdCheck(args *skel.CmdArgs) error {
 	}
 	defer netns.Close()
 
-	return bridge.CheckVeth(netns, args.IfName, podIP)
+	vethConf := newVethConf(conf, args, im.IPNet(podIP), im.Gateway())
+	if sub := subIfConf(conf); sub != nil {
+		return bridge.CheckSubIf(netns, sub, vethConf)
+	}
+	if vethConf.L3 {
+		return bridge.CheckVeth(netns, "", vethConf)
+	}
+	if err := bridge.CheckBridge(bridgeConf(conf, im)); err != nil {
+		return err
+	}
+	return bridge.CheckVeth(netns, conf.Bridge, vethConf)
+}
+
+// subIfConf 根据网络配置生成 macvlan/ipvlan 子接口配置，bridge 模式下返回 nil
+func subIfConf(conf *config.CNIConf) *bridge.SubIfConf {
+	switch conf.Mode {
+	case config.ModeMacvlan:
+		return &bridge.SubIfConf{Kind: bridge.KindMacvlan, Master: conf.Master}
+	case config.ModeIPVlan:
+		return &bridge.SubIfConf{Kind: bridge.KindIPVlan, Master: conf.Master, L3: conf.IPVlanMode == config.IPVlanModeL3}
+	}
+	return nil
+}
+
+// bridgeConf 根据网络配置生成网桥配置
+func bridgeConf(conf *config.CNIConf, im *ipam.IPAM) *bridge.BridgeConf {
+	return &bridge.BridgeConf{
+		Name:          conf.Bridge,
+		MTU:           mtu,
+		Gateway:       im.IPNet(im.Gateway()),
+		PromiscMode:   conf.PromiscMode,
+		VlanFiltering: conf.VlanFiltering,
+		Vlan:          conf.Vlan,
+		Uplink:        conf.Uplink,
+	}
+}
+
+// newVethConf 根据网络配置生成容器接口的 veth 配置，l3 模式下容器使用 /32 地址
+func newVethConf(conf *config.CNIConf, args *skel.CmdArgs, podIP *net.IPNet, gateway net.IP) *bridge.VethConf {
+	l3 := conf.Mode == config.ModeL3
+	if l3 {
+		bits := len(podIP.IP) * 8
+		if podIP.IP.To4() != nil {
+			bits = 32
+		}
+		podIP = &net.IPNet{IP: podIP.IP, Mask: net.CIDRMask(bits, bits)}
+	}
+	return &bridge.VethConf{
+		IfName:      args.IfName,
+		HostName:    bridge.HostVethName(conf.VethPrefix, args.ContainerID, args.IfName),
+		MTU:         mtu,
+		PodIP:       podIP,
+		Gateway:     gateway,
+		HairpinMode: conf.HairpinMode,
+		Tuning:      tuning(conf),
+		Vlan:        conf.Vlan,
+		L3:          l3,
+	}
+}
+
+// tuning 根据网络配置生成容器内接口的 sysctl 与网卡参数，都没有配置时返回 nil
+func tuning(conf *config.CNIConf) *bridge.Tuning {
+	if len(conf.Sysctl) == 0 && conf.Tuning == nil {
+		return nil
+	}
+	t := &bridge.Tuning{Sysctl: conf.Sysctl}
+	if conf.Tuning != nil {
+		t.DisableIPv6RA = conf.Tuning.DisableIPv6RA
+		t.TxQueueLen = conf.Tuning.TxQueueLen
+		t.Offloads = conf.Tuning.Offloads
+		t.Promisc = conf.Tuning.Promisc
+	}
+	return t
 }
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/kerolt/simple-cni/pkg/store"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// allocationGC 定期回收本节点上 Pod 已经不存在的 IPAllocation（crd 存储后端）
+//
+// 正常情况下 IPAllocation 以 Pod 为 owner，会随 Pod 一起被 Kubernetes 回收；
+// 这里处理的是没有 owner 的记录（例如 CNI_ARGS 中缺少 Pod UID）以及 Pod 被同名重建后遗留的记录
+type allocationGC struct {
+	client   client.Client
+	reader   client.Reader // 直接读 API Server，避免为所有 Pod 建立缓存
+	nodeName string
+	interval time.Duration
+	// minAge 分配之后至少经过多久才回收，避免 Pod 被同名重建时，读到旧 Pod 而把新 Pod 刚分配的记录当作遗留记录删除
+	minAge time.Duration
+}
+
+func (g *allocationGC) Start(ctx context.Context) error {
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := g.collect(ctx); err != nil {
+			log.Error(err, "failed to collect IPAllocations")
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (g *allocationGC) collect(ctx context.Context) error {
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(store.IPAllocationGVK.GroupVersion().WithKind(store.IPAllocationGVK.Kind + "List"))
+	if err := g.reader.List(ctx, list, client.MatchingLabels{store.LabelNode: g.nodeName}); err != nil {
+		return err
+	}
+
+	for i := range list.Items {
+		obj := &list.Items[i]
+		spec, err := store.ParseIPAllocation(obj)
+		if err != nil {
+			log.Error(err, "invalid IPAllocation", "namespace", obj.GetNamespace(), "name", obj.GetName())
+			continue
+		}
+		if !spec.Allocated() || spec.Pod == "" {
+			continue
+		}
+		// 没有分配时间的记录按创建时间计算
+		allocatedAt, err := time.Parse(time.RFC3339, spec.AllocatedAt)
+		if err != nil {
+			allocatedAt = obj.GetCreationTimestamp().Time
+		}
+		if time.Since(allocatedAt) < g.minAge {
+			continue
+		}
+
+		alive, err := g.podAlive(ctx, spec)
+		if err != nil {
+			return err
+		}
+		if alive {
+			continue
+		}
+
+		// 带上 resourceVersion，插件在此期间更新过的对象不会被误删
+		rv := obj.GetResourceVersion()
+		if err := g.client.Delete(ctx, obj, client.Preconditions{ResourceVersion: &rv}); err != nil && !apierrors.IsNotFound(err) && !apierrors.IsConflict(err) {
+			return err
+		}
+		log.Info("released IPAllocation of deleted pod", "ip", spec.IP, "pod", spec.Pod, "containerID", spec.ContainerID)
+	}
+
+	return nil
+}
+
+// podAlive 判断 IPAllocation 记录的 Pod 是否仍然存在
+func (g *allocationGC) podAlive(ctx context.Context, spec *store.IPAllocationSpec) (bool, error) {
+	namespace, name, ok := store.SplitPodKey(spec.Pod)
+	if !ok {
+		return true, nil
+	}
+
+	pod := &corev1.Pod{}
+	if err := g.reader.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, pod); err != nil {
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return spec.PodUID == "" || string(pod.UID) == spec.PodUID, nil
+}
@@ -8,11 +8,12 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"time"
 
 	"github.com/kerolt/simple-cni/pkg/bridge"
 	myconf "github.com/kerolt/simple-cni/pkg/config"
+	"github.com/kerolt/simple-cni/pkg/ipam"
 
-	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/coreos/go-iptables/iptables"
 	"github.com/vishvananda/netlink"
 	corev1 "k8s.io/api/core/v1"
@@ -35,10 +36,17 @@ var (
 
 // 保存守护进程（daemon）的配置信息
 type daemonConf struct {
-	clusterCIDR    string // 集群 CIDR
-	nodeName       string // 节点名称
-	enableIptables bool   // 是否启用 iptables 规则
-	useNftables    bool   // 是否使用 nftables（优先于 iptables）
+	clusterCIDR    string        // 集群 CIDR
+	nodeName       string        // 节点名称
+	enableIptables bool          // 是否启用 iptables 规则
+	useNftables    bool          // 是否使用 nftables（优先于 iptables）
+	gateway        string        // 网桥的网关地址，为空时使用 PodCIDR 的第一个可用地址
+	allocationGC   time.Duration // 回收 IPAllocation 的周期，为 0 表示不回收（仅用于 crd 存储后端）
+	allocationAge  time.Duration // IPAllocation 分配之后至少经过多久才会被回收
+	cniConf        string        // 插件的网络配置文件，节点 GC 通过它找到 store
+	nodeGC         time.Duration // 回收本节点泄漏的 IP 与 veth 的周期，为 0 表示不回收
+	nodeGCGrace    time.Duration // 分配记录与 veth 持续找不到 Pod 多久之后才回收
+	nodeGCDryRun   bool          // 节点 GC 只打印需要回收的对象
 }
 
 func (d *daemonConf) addFlags() {
@@ -46,6 +54,13 @@ func (d *daemonConf) addFlags() {
 	flag.StringVar(&d.nodeName, "node-name", "", "Node Name")
 	flag.BoolVar(&d.enableIptables, "enable-iptables", false, "Enable iptables")
 	flag.BoolVar(&d.useNftables, "use-nftables", false, "Use nftables instead of iptables")
+	flag.DurationVar(&d.allocationGC, "ipallocation-gc-interval", 0, "Interval to garbage-collect IPAllocations of deleted pods, 0 disables it (crd store only)")
+	flag.DurationVar(&d.allocationAge, "ipallocation-gc-min-age", 5*time.Minute, "Minimum age of an IPAllocation before it can be garbage-collected")
+	flag.StringVar(&d.gateway, "gateway", "", "Bridge gateway address, must be inside the node PodCIDR (default: first address of the PodCIDR)")
+	flag.StringVar(&d.cniConf, "cni-conf", "/etc/simple-cni/cni-conf.json", "CNI network config used by the plugin")
+	flag.DurationVar(&d.nodeGC, "node-gc-interval", 0, "Interval to release allocations and delete veths of pods no longer on this node, 0 disables it")
+	flag.DurationVar(&d.nodeGCGrace, "node-gc-grace", 5*time.Minute, "How long an allocation or veth must stay orphaned before it is collected")
+	flag.BoolVar(&d.nodeGCDryRun, "node-gc-dry-run", false, "Only log what the node GC would collect")
 }
 
 // 解析并验证配置参数
@@ -85,8 +100,13 @@ func (r *reconciler) Reconcile(ctx context.Context, req reconcile.Request) (reco
 	routes := make(map[string]netlink.Route)
 
 	for _, node := range nodes.Items {
-		// 跳过自身节点
+		// 本节点不需要路由，PodCIDR 变化时迁移网桥地址
 		if node.Name == r.conf.nodeName {
+			if node.Spec.PodCIDR != "" && node.Spec.PodCIDR != r.subnetConfig.Subnet {
+				if err := r.setupNodeSubnet(node.Spec.PodCIDR); err != nil {
+					return result, err
+				}
+			}
 			continue
 		}
 
@@ -193,21 +213,6 @@ func newReconciler(conf *daemonConf, mgr manager.Manager) (*reconciler, error) {
 		return nil, fmt.Errorf("failed to get host ip for node %s", conf.nodeName)
 	}
 
-	// 解析本节点的pod CIDR
-	_, nodeCIDR, err := net.ParseCIDR(node.Spec.PodCIDR)
-	if err != nil {
-		return nil, err
-	}
-
-	// 生成并持久化 subnet.json
-	subnetConf := &myconf.SubnetConf{
-		Subnet: nodeCIDR.String(),
-		Bridge: myconf.DefaultBridgeName,
-	}
-	if err := myconf.StoreSubnetConfig(subnetConf); err != nil {
-		return nil, err
-	}
-
 	linkList, err := netlink.LinkList()
 	if err != nil {
 		return nil, err
@@ -239,17 +244,14 @@ func newReconciler(conf *daemonConf, mgr manager.Manager) (*reconciler, error) {
 
 	log.Info("get host link successful, name: %s, index: %s", hostLink.Attrs().Name, hostLink.Attrs().Index)
 
-	// 创建网桥设备，网桥的 IP 通常是 PodCIDR 的第一个可用 IP
-	if _, err := bridge.CreateBridge(subnetConf.Bridge, 1500, &net.IPNet{IP: ip.NextIP(nodeCIDR.IP), Mask: nodeCIDR.Mask}); err != nil {
-		return nil, err
+	r := &reconciler{
+		client:      mgr.GetClient(),
+		clusterCIDR: clusterCIDR,
+		hostLink:    hostLink,
+		conf:        conf,
 	}
-
-	// 设置防火墙转发与 NAT 规则
-	if conf.enableIptables {
-		if err := addIPTables(subnetConf.Bridge, hostLink.Attrs().Name, subnetConf.Subnet); err != nil {
-			return nil, err
-		}
-		log.Info("set iptables successful")
+	if err := r.setupNodeSubnet(node.Spec.PodCIDR); err != nil {
+		return nil, err
 	}
 
 	routes := make(map[string]netlink.Route)
@@ -260,19 +262,176 @@ func newReconciler(conf *daemonConf, mgr manager.Manager) (*reconciler, error) {
 
 	// 把当前宿主上存在、且其目的网段落在 clusterCIDR（集群网段）内的路由收集到 routes map
 	for _, route := range routeList {
-		if route.Dst != nil && route.Dst.String() != nodeCIDR.String() && clusterCIDR.Contains(route.Dst.IP) {
+		if route.Dst != nil && route.Dst.String() != r.subnetConfig.Subnet && clusterCIDR.Contains(route.Dst.IP) {
 			routes[route.Dst.String()] = route
 		}
 	}
+	r.routes = routes
+
+	return r, nil
+}
+
+// setupNodeSubnet 按本节点的 PodCIDR 生成 subnets.json，并配置网桥与防火墙规则，启动时以及 PodCIDR 变化时调用
+//
+// PodCIDR 或网关变化时，旧的网关记录在 subnets.json 的 previousGateway 中。新的网关地址先于旧地址的删除添加到网桥上，
+// 迁移过程中网桥上始终有网关；开启了 bridgeTeardown 时保留旧地址，还接在网桥上的旧 Pod 可以继续使用，
+// 最后一个端口被删除后由 DEL 或节点 GC 删除整个网桥
+func (r *reconciler) setupNodeSubnet(podCIDR string) error {
+	_, nodeCIDR, err := net.ParseCIDR(podCIDR)
+	if err != nil {
+		return err
+	}
+
+	netConf, err := loadNetworkConfig(r.conf.cniConf)
+	if err != nil {
+		return err
+	}
+
+	// 计算网关地址，插件的 IPAM 会从 subnets.json 中读取同一个网关
+	gateway, err := ipam.ParseGateway(nodeCIDR, nodeGateway(r.conf, netConf, nodeCIDR))
+	if err != nil {
+		return err
+	}
+	gatewayNet := &net.IPNet{IP: gateway, Mask: nodeCIDR.Mask}
+
+	// 生成并持久化 subnet.json
+	subnetConf := &myconf.SubnetConf{
+		Subnet:  nodeCIDR.String(),
+		Bridge:  myconf.DefaultBridgeName,
+		Node:    r.conf.nodeName,
+		Gateway: gateway.String(),
+	}
+	if netConf != nil && netConf.Bridge != "" {
+		subnetConf.Bridge = netConf.Bridge
+	}
+
+	var previous *net.IPNet
+	changed := false
+	if old, err := myconf.LoadSubnetConfig(); err == nil {
+		if previous, changed, err = previousGateway(old, subnetConf); err != nil {
+			log.Error(err, "ignoring invalid gateway in the previous subnet config")
+		}
+		if changed {
+			log.Info("subnet changed, migrating bridge address", "bridge", subnetConf.Bridge,
+				"oldSubnet", old.Subnet, "oldGateway", previous.String(), "subnet", subnetConf.Subnet, "gateway", subnetConf.Gateway)
+		}
+	}
+	if previous != nil {
+		subnetConf.PreviousGateway = previous.String()
+	}
+	if err := myconf.StoreSubnetConfig(subnetConf); err != nil {
+		return err
+	}
+
+	// 创建网桥设备，网桥的 IP 即网关地址，默认是 PodCIDR 的第一个可用 IP
+	bridgeConf := nodeBridgeConf(subnetConf, netConf, gatewayNet)
+	if _, err := bridge.CreateBridge(bridgeConf); err != nil {
+		return err
+	}
+
+	// 新的网关已经在网桥上，不需要等待旧 Pod 时直接删除旧的网关地址
+	if changed && (netConf == nil || !netConf.BridgeTeardown) {
+		if err := bridge.RemoveAddr(bridgeConf.GatewayLink(), previous); err != nil {
+			return err
+		}
+		log.Info("removed previous gateway address", "address", previous.String())
+	}
+
+	// 设置防火墙转发与 NAT 规则，设置了 VLAN 时容器的报文从网桥的 VLAN 子接口进出宿主机的协议栈
+	if r.conf.enableIptables {
+		if err := addIPTables(bridgeConf.GatewayLink(), r.hostLink.Attrs().Name, subnetConf.Subnet); err != nil {
+			return err
+		}
+		log.Info("set iptables successful")
+	}
+
+	r.subnetConfig = subnetConf
+	return nil
+}
+
+// previousGateway 比较旧的 subnets.json 记录 old 与新的记录 current，返回 current 需要记录的 previousGateway
+//
+// 网关地址发生变化时 changed 为 true，previous 是变化之前的网关，需要从网桥上迁移走；没有变化时沿用 old 中
+// 尚未清理的 previousGateway。两边的网关都按 ipam.ParseGateway 解析后比较 IP，旧版本写入的没有 gateway 字段的
+// 记录也能得到相同的结果；与当前网关相同的地址不会被记录，否则 bridgeTeardown 会删除正在使用的网桥
+func previousGateway(old, current *myconf.SubnetConf) (previous *net.IPNet, changed bool, err error) {
+	gateway, err := subnetGateway(current)
+	if err != nil {
+		return nil, false, err
+	}
+	oldGateway, err := subnetGateway(old)
+	if err != nil {
+		return nil, false, err
+	}
+	if !oldGateway.IP.Equal(gateway.IP) {
+		return oldGateway, true, nil
+	}
+
+	// 还没有被清理的旧网关继续保留在记录中，换了网桥之后不再适用
+	if old.Bridge != current.Bridge {
+		return nil, false, nil
+	}
+	previous, err = old.PreviousGatewayNet()
+	if err != nil || previous == nil || previous.IP.Equal(gateway.IP) {
+		return nil, false, err
+	}
+	return previous, false, nil
+}
+
+// subnetGateway 返回 subnets.json 中记录的带子网掩码的网关地址，与插件的 IPAM 一样通过 ipam.ParseGateway 解析与校验
+func subnetGateway(c *myconf.SubnetConf) (*net.IPNet, error) {
+	_, subnet, err := net.ParseCIDR(c.Subnet)
+	if err != nil {
+		return nil, err
+	}
+	gateway, err := ipam.ParseGateway(subnet, c.Gateway)
+	if err != nil {
+		return nil, err
+	}
+	return &net.IPNet{IP: gateway, Mask: subnet.Mask}, nil
+}
+
+// loadNetworkConfig 读取插件的网络配置，文件不存在时返回 nil
+func loadNetworkConfig(file string) (*myconf.CNIConf, error) {
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Info("network config not found, using defaults", "file", file)
+			return nil, nil
+		}
+		return nil, err
+	}
+	return myconf.ParseNetworkConfig(raw)
+}
 
-	return &reconciler{
-		client:       mgr.GetClient(),
-		clusterCIDR:  clusterCIDR,
-		hostLink:     hostLink,
-		routes:       routes,
-		conf:         conf,
-		subnetConfig: subnetConf,
-	}, nil
+// nodeGateway 返回本节点网桥的网关地址，为空时使用 PodCIDR 的第一个可用地址
+//
+// 网络配置中的 gateway 会覆盖 subnets.json，插件最终使用的是它，所以优先于 --gateway。
+// 网络配置指定了其他子网时，它的网关属于那个网络，不适用于节点的 PodCIDR
+func nodeGateway(conf *daemonConf, netConf *myconf.CNIConf, nodeCIDR *net.IPNet) string {
+	if netConf == nil || netConf.Gateway == "" || (netConf.Subnet != "" && netConf.Subnet != nodeCIDR.String()) {
+		return conf.gateway
+	}
+	if conf.gateway != "" && conf.gateway != netConf.Gateway {
+		log.Info("gateway in the network config overrides --gateway", "gateway", netConf.Gateway, "flag", conf.gateway)
+	}
+	return netConf.Gateway
+}
+
+// nodeBridgeConf 返回节点网桥的配置，网络配置作用于节点的 PodCIDR 时使用其中的 VLAN 设置，与插件创建的网桥保持一致
+func nodeBridgeConf(subnetConf *myconf.SubnetConf, netConf *myconf.CNIConf, gateway *net.IPNet) *bridge.BridgeConf {
+	bc := &bridge.BridgeConf{
+		Name:    subnetConf.Bridge,
+		MTU:     1500,
+		Gateway: gateway,
+	}
+	if netConf == nil || netConf.Mode != myconf.ModeBridge || (netConf.Subnet != "" && netConf.Subnet != subnetConf.Subnet) {
+		return bc
+	}
+	bc.VlanFiltering = netConf.VlanFiltering
+	bc.Vlan = netConf.Vlan
+	bc.Uplink = netConf.Uplink
+	return bc
 }
 
 func addIPTables(bridgeName, hostDeviceName, nodeCIDR string) error {
@@ -390,5 +549,33 @@ func runController(conf *daemonConf) error {
 		return err
 	}
 
+	if conf.allocationGC > 0 {
+		gc := &allocationGC{
+			client:   mgr.GetClient(),
+			reader:   mgr.GetAPIReader(),
+			nodeName: conf.nodeName,
+			interval: conf.allocationGC,
+			minAge:   conf.allocationAge,
+		}
+		if err := mgr.Add(gc); err != nil {
+			return err
+		}
+	}
+
+	if conf.nodeGC > 0 {
+		gc := &nodeGC{
+			reader:   mgr.GetAPIReader(),
+			nodeName: conf.nodeName,
+			confFile: conf.cniConf,
+			interval: conf.nodeGC,
+			grace:    conf.nodeGCGrace,
+			dryRun:   conf.nodeGCDryRun,
+			orphans:  make(map[string]time.Time),
+		}
+		if err := mgr.Add(gc); err != nil {
+			return err
+		}
+	}
+
 	return mgr.Start(signals.SetupSignalHandler())
 }
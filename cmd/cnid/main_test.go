@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+
+	myconf "github.com/kerolt/simple-cni/pkg/config"
+)
+
+func TestPreviousGateway(t *testing.T) {
+	current := myconf.SubnetConf{Subnet: "10.244.1.0/24", Bridge: "simple-cni0", Gateway: "10.244.1.1"}
+
+	tests := []struct {
+		name        string
+		old         myconf.SubnetConf
+		current     myconf.SubnetConf
+		wantPrev    string
+		wantChanged bool
+	}{
+		{
+			// 旧版本写入的 subnets.json 没有 gateway 字段，网关就是子网的第一个可用地址，并没有变化
+			name:    "old file without gateway",
+			old:     myconf.SubnetConf{Subnet: "10.244.1.0/24", Bridge: "simple-cni0"},
+			current: current,
+		},
+		{
+			name:    "unchanged",
+			old:     current,
+			current: current,
+		},
+		{
+			name:        "subnet changed",
+			old:         myconf.SubnetConf{Subnet: "10.244.7.0/24", Bridge: "simple-cni0"},
+			current:     current,
+			wantPrev:    "10.244.7.1/24",
+			wantChanged: true,
+		},
+		{
+			name:        "gateway changed",
+			old:         myconf.SubnetConf{Subnet: "10.244.1.0/24", Bridge: "simple-cni0", Gateway: "10.244.1.254"},
+			current:     current,
+			wantPrev:    "10.244.1.254/24",
+			wantChanged: true,
+		},
+		{
+			name:     "keep previous gateway not cleaned up yet",
+			old:      myconf.SubnetConf{Subnet: "10.244.1.0/24", Bridge: "simple-cni0", Gateway: "10.244.1.1", PreviousGateway: "10.244.7.1/24"},
+			current:  current,
+			wantPrev: "10.244.7.1/24",
+		},
+		{
+			name:    "previous gateway on another bridge",
+			old:     myconf.SubnetConf{Subnet: "10.244.1.0/24", Bridge: "cni1", Gateway: "10.244.1.1", PreviousGateway: "10.244.7.1/24"},
+			current: current,
+		},
+		{
+			// 有问题的版本把当前网关记录成了 previousGateway，不能沿用，否则会删除正在使用的网桥
+			name:    "previous gateway equal to the current gateway",
+			old:     myconf.SubnetConf{Subnet: "10.244.1.0/24", Bridge: "simple-cni0", PreviousGateway: "10.244.1.1/24"},
+			current: current,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			previous, changed, err := previousGateway(&tt.old, &tt.current)
+			if err != nil {
+				t.Fatalf("previousGateway: %v", err)
+			}
+			got := ""
+			if previous != nil {
+				got = previous.String()
+			}
+			if got != tt.wantPrev || changed != tt.wantChanged {
+				t.Errorf("previousGateway() = %q, %v, want %q, %v", got, changed, tt.wantPrev, tt.wantChanged)
+			}
+		})
+	}
+}
+
+func TestPreviousGatewayInvalid(t *testing.T) {
+	current := &myconf.SubnetConf{Subnet: "10.244.1.0/24", Bridge: "simple-cni0"}
+	// 网关不在子网内，与插件的 IPAM 一样拒绝
+	old := &myconf.SubnetConf{Subnet: "10.244.7.0/24", Bridge: "simple-cni0", Gateway: "10.244.8.1"}
+	if previous, changed, err := previousGateway(old, current); err == nil {
+		t.Errorf("previousGateway() = %v, %v, want error", previous, changed)
+	}
+}
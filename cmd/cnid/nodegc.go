@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/kerolt/simple-cni/pkg/bridge"
+	myconf "github.com/kerolt/simple-cni/pkg/config"
+	"github.com/kerolt/simple-cni/pkg/ipam"
+	"github.com/kerolt/simple-cni/pkg/store"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// nodeGC 定期对比本节点上的 Pod、store 中的分配记录以及网桥上的 veth，
+// 回收因为 DEL 没有到达（kubelet 崩溃、节点重启等）而泄漏的 IP 与 veth
+//
+// 分配记录或 veth 需要连续 grace 时间都找不到对应的 Pod 才会被回收，避免与正在进行的 ADD/DEL 竞争
+type nodeGC struct {
+	reader   client.Reader // 直接读 API Server，避免为所有 Pod 建立缓存
+	nodeName string
+	confFile string // 插件的网络配置文件
+	interval time.Duration
+	grace    time.Duration
+	dryRun   bool // 只打印需要回收的对象，不做修改
+
+	// 第一次发现孤儿分配记录或 veth 的时间，key 是 orphanKey 的返回值（分配记录的 IP）或 veth 名称
+	orphans map[string]time.Time
+}
+
+func (g *nodeGC) Start(ctx context.Context) error {
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := g.collect(ctx); err != nil {
+			log.Error(err, "failed to collect leaked allocations")
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// podIfName 是 kubelet 为 Pod 主网络使用的接口名，Pod 状态中上报的只有这个接口的 IP
+const podIfName = "eth0"
+
+// livePods 是本节点上仍在运行的 Pod
+type livePods struct {
+	uids     map[string]string   // key 是 <namespace>/<name>，value 是 Pod 的 UID
+	ips      map[string]bool     // Pod 状态中上报的 IP
+	reported map[string][]string // key 是 <namespace>/<name>，value 是该 Pod 状态中上报的 IP
+}
+
+func (g *nodeGC) collect(ctx context.Context) error {
+	raw, err := os.ReadFile(g.confFile)
+	if err != nil {
+		return err
+	}
+	conf, err := myconf.LoadCNIConfig(raw, "")
+	if err != nil {
+		return err
+	}
+
+	pods, err := g.listPods(ctx)
+	if err != nil {
+		return err
+	}
+
+	s, err := store.New(store.Options{
+		Kind:       conf.Store,
+		Dir:        conf.DataDir,
+		Network:    conf.Name,
+		Kubeconfig: conf.Kubeconfig,
+		Node:       conf.Node,
+	})
+	if err != nil {
+		return err
+	}
+	im, err := ipam.NewIPAM(conf, s)
+	if err != nil {
+		s.Close()
+		return err
+	}
+	defer im.Close()
+
+	entries, err := im.Allocations()
+	if err != nil {
+		return err
+	}
+	liveIPs, err := bridge.LiveIPs(conf.Bridge, im.Subnet())
+	if err != nil {
+		return err
+	}
+	live := make(map[string]bool)
+	for _, ip := range liveIPs {
+		live[ip.String()] = true
+	}
+
+	now := time.Now()
+	seen := make(map[string]bool)
+
+	// 找出没有对应 Pod 的分配记录
+	leaked := make(map[string]bool)
+	inUse := make(map[string]bool) // 仍属于存活 Pod 的 IP
+	for _, e := range entries {
+		if !g.orphaned(e, pods, live, now) {
+			inUse[e.IP] = true
+			continue
+		}
+
+		key := orphanKey(e.IP)
+		seen[key] = true
+		if !g.expired(key, now) {
+			continue
+		}
+		leaked[key] = true
+		log.Info("releasing leaked allocation", "ip", e.IP, "containerID", e.ContainerID, "ifName", e.IfName, "pod", e.Pod(), "dryRun", g.dryRun)
+	}
+
+	if len(leaked) > 0 && !g.dryRun {
+		veths := make(map[string]string) // key 是宿主机端 veth 的名称，value 是容器网络命名空间的路径
+		released, err := im.ReleaseMatching(func(ip net.IP, alloc store.Allocation) bool {
+			if !leaked[orphanKey(ip.String())] {
+				return false
+			}
+			// 恢复出来的记录没有真实的容器 ID，对应的 veth 只能由下面的网桥端口检查回收
+			if alloc.ContainerID != store.RecoveredContainerID && alloc.Netns != "" {
+				veths[bridge.HostVethName(conf.VethPrefix, alloc.ContainerID, alloc.IfName)] = alloc.Netns
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		for _, ip := range released {
+			log.Info("released leaked allocation", "ip", ip.String())
+		}
+
+		// 宿主机端 veth 的名称由容器 ID 与接口名称决定，可以直接删除，不需要等到它出现在下面的网桥端口中
+		if conf.UsesVeth() {
+			for name, netnsPath := range veths {
+				g.delHostVeth(name, netnsPath)
+			}
+		}
+	}
+
+	// macvlan/ipvlan 子接口在容器网络命名空间中，随命名空间一起删除；l3 模式下的 veth 不在网桥上，只能通过上面的分配记录回收
+	if conf.Mode == myconf.ModeBridge {
+		if err := g.collectVeths(conf.Bridge, inUse, pods, seen, now); err != nil {
+			return err
+		}
+
+		// 子网变化后，最后一个旧 Pod 的 DEL 没有到达时由这里清理网桥，持有 store 的锁避免与 ADD 交错
+		if conf.BridgeTeardown && !g.dryRun {
+			previous, err := conf.PreviousGatewayNet()
+			if err != nil {
+				return err
+			}
+			// 与当前网关相同的地址不是过期的地址，网桥仍在使用
+			if previous != nil && previous.IP.Equal(im.Gateway()) {
+				previous = nil
+			}
+			var deleted bool
+			err = im.WithLock(func() error {
+				deleted, err = bridge.RemoveStaleBridge(conf.Bridge, previous)
+				return err
+			})
+			if err != nil {
+				log.Error(err, "failed to remove stale bridge", "bridge", conf.Bridge)
+			} else if deleted {
+				log.Info("removed stale bridge", "bridge", conf.Bridge)
+			}
+		}
+	}
+
+	// 已经恢复正常或已被回收的对象不再跟踪
+	for key := range g.orphans {
+		if !seen[key] || (leaked[key] && !g.dryRun) {
+			delete(g.orphans, key)
+		}
+	}
+	return nil
+}
+
+// collectVeths 删除网桥上不属于任何存活 Pod、也不对应仍在使用的分配记录的 veth
+func (g *nodeGC) collectVeths(bridgeName string, inUse map[string]bool, pods *livePods, seen map[string]bool, now time.Time) error {
+	// 找出不属于任何存活 Pod 的 veth，只能关联到 IP 的 veth 才会被处理
+	ports, err := bridge.Ports(bridgeName)
+	if err != nil {
+		return err
+	}
+	for _, p := range ports {
+		if len(p.IPs) == 0 {
+			continue
+		}
+		orphan := true
+		for _, ip := range p.IPs {
+			if inUse[ip.String()] || pods.ips[ip.String()] {
+				orphan = false
+				break
+			}
+		}
+		if !orphan {
+			continue
+		}
+
+		seen[p.Name] = true
+		if !g.expired(p.Name, now) {
+			continue
+		}
+		log.Info("deleting leaked veth", "veth", p.Name, "ips", p.IPs, "dryRun", g.dryRun)
+		if g.dryRun {
+			continue
+		}
+		link, err := netlink.LinkByIndex(p.Index)
+		if err != nil || link.Attrs().Name != p.Name {
+			continue
+		}
+		if err := netlink.LinkDel(link); err != nil {
+			log.Error(err, "failed to delete leaked veth", "veth", p.Name)
+			continue
+		}
+		delete(g.orphans, p.Name)
+	}
+	return nil
+}
+
+// delHostVeth 删除泄漏的分配记录对应的宿主机端 veth
+//
+// 只有另一端确实在记录的网络命名空间中时才删除，避免删掉名称冲突的其他 Pod 的 veth。
+// 网络命名空间已经不存在时 veth 随之消失；cnid 没有挂载 /var/run/netns 时无法确认，交给网桥端口的检查回收
+func (g *nodeGC) delHostVeth(name, netnsPath string) {
+	netns, err := ns.GetNS(netnsPath)
+	if err != nil {
+		if _, ok := err.(ns.NSPathNotExistErr); !ok {
+			log.Error(err, "failed to open netns of leaked veth", "veth", name, "netns", netnsPath)
+		}
+		return
+	}
+	defer netns.Close()
+
+	if deleted, err := bridge.DelHostVeth(netns, name); err != nil {
+		log.Error(err, "failed to delete leaked veth", "veth", name)
+	} else if deleted {
+		log.Info("deleted leaked veth", "veth", name)
+	}
+}
+
+// listPods 列出本节点上仍在运行、使用 Pod 网络的 Pod
+func (g *nodeGC) listPods(ctx context.Context) (*livePods, error) {
+	list := &corev1.PodList{}
+	if err := g.reader.List(ctx, list, client.MatchingFields{"spec.nodeName": g.nodeName}); err != nil {
+		return nil, err
+	}
+
+	pods := &livePods{uids: make(map[string]string), ips: make(map[string]bool), reported: make(map[string][]string)}
+	for _, pod := range list.Items {
+		if pod.Spec.HostNetwork || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		key := pod.Namespace + "/" + pod.Name
+		pods.uids[key] = string(pod.UID)
+		for _, ip := range pod.Status.PodIPs {
+			pods.ips[ip.IP] = true
+			pods.reported[key] = append(pods.reported[key], ip.IP)
+		}
+	}
+	return pods, nil
+}
+
+// orphaned 判断分配记录是否已经没有对应的 Pod
+//
+// 没有 Pod 信息的记录（旧版本数据或非 Kubernetes 容器）无法判断，只处理从网络接口恢复出来、且已经找不到接口的记录。
+// Pod 状态中上报的 IP 总是视为在使用：cnid 看不到容器的网络命名空间，恢复出来的记录主要靠它判断。
+// Pod 的沙箱重建而旧沙箱的 DEL 没有到达时，Pod 仍然存在，但上报的已经是新沙箱的 IP，旧沙箱主接口的记录同样视为孤儿
+func (g *nodeGC) orphaned(e ipam.Entry, pods *livePods, live map[string]bool, now time.Time) bool {
+	if !e.AllocatedAt.IsZero() && now.Sub(e.AllocatedAt) < g.grace {
+		return false
+	}
+	if pods.ips[e.IP] {
+		return false
+	}
+
+	pod := e.Pod()
+	if pod == "" {
+		return e.ContainerID == store.RecoveredContainerID && !live[e.IP]
+	}
+
+	uid, ok := pods.uids[pod]
+	if !ok {
+		return true
+	}
+	if e.PodUID != "" && uid != e.PodUID {
+		return true
+	}
+	reported := pods.reported[pod]
+	return e.IfName == podIfName && len(reported) > 0 && !slices.Contains(reported, e.IP)
+}
+
+// expired 记录第一次发现孤儿的时间，判断是否已经超过 grace
+func (g *nodeGC) expired(key string, now time.Time) bool {
+	first, ok := g.orphans[key]
+	if !ok {
+		g.orphans[key] = now
+		return g.grace <= 0
+	}
+	return now.Sub(first) >= g.grace
+}
+
+// orphanKey 返回分配记录在 orphans 中的 key，按 IP 区分，恢复出来的记录共用同一个容器 ID
+func orphanKey(ip string) string {
+	return "ip/" + ip
+}
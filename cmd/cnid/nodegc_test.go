@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kerolt/simple-cni/pkg/ipam"
+	"github.com/kerolt/simple-cni/pkg/store"
+)
+
+func TestOrphaned(t *testing.T) {
+	now := time.Now()
+	g := &nodeGC{grace: 5 * time.Minute}
+	pods := &livePods{
+		uids:     map[string]string{"default/web-0": "uid-1", "default/pending": "uid-2"},
+		ips:      map[string]bool{"10.244.1.2": true},
+		reported: map[string][]string{"default/web-0": {"10.244.1.2"}},
+	}
+	live := map[string]bool{"10.244.1.9": true}
+	old := now.Add(-time.Hour)
+
+	entry := func(ip, ifName, pod, uid string) ipam.Entry {
+		alloc := store.Allocation{ContainerID: "c1", IfName: ifName, PodUID: uid, AllocatedAt: old}
+		if pod != "" {
+			alloc.PodNamespace, alloc.PodName, _ = store.SplitPodKey(pod)
+		}
+		return ipam.Entry{IP: ip, Allocation: alloc}
+	}
+
+	tests := []struct {
+		name  string
+		entry ipam.Entry
+		want  bool
+	}{
+		{name: "reported by the pod", entry: entry("10.244.1.2", "eth0", "default/web-0", "uid-1")},
+		{name: "pod deleted", entry: entry("10.244.1.3", "eth0", "default/web-1", "uid-3"), want: true},
+		{name: "pod recreated", entry: entry("10.244.1.3", "eth0", "default/web-0", "uid-0"), want: true},
+		{
+			// 旧沙箱的 DEL 没有到达，Pod 上报的是新沙箱的 IP
+			name:  "sandbox recreated",
+			entry: entry("10.244.1.3", "eth0", "default/web-0", "uid-1"),
+			want:  true,
+		},
+		{name: "sandbox recreated without uid", entry: entry("10.244.1.3", "eth0", "default/web-0", ""), want: true},
+		{
+			// 其他接口的 IP 不会出现在 Pod 状态中
+			name:  "secondary interface",
+			entry: entry("10.244.1.3", "net1", "default/web-0", "uid-1"),
+		},
+		{
+			// Pod 还没有上报 IP，无法判断
+			name:  "pod without reported ips",
+			entry: entry("10.244.1.3", "eth0", "default/pending", "uid-2"),
+		},
+		{
+			name: "within grace",
+			entry: ipam.Entry{IP: "10.244.1.3", Allocation: store.Allocation{
+				ContainerID: "c1", IfName: "eth0", PodNamespace: "default", PodName: "web-0", PodUID: "uid-1", AllocatedAt: now,
+			}},
+		},
+		{name: "no pod", entry: entry("10.244.1.3", "eth0", "", "")},
+		{name: "recovered and gone", entry: ipam.Entry{IP: "10.244.1.3", Allocation: store.Allocation{ContainerID: store.RecoveredContainerID}}, want: true},
+		{name: "recovered and live", entry: ipam.Entry{IP: "10.244.1.9", Allocation: store.Allocation{ContainerID: store.RecoveredContainerID}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := g.orphaned(tt.entry, pods, live, now); got != tt.want {
+				t.Errorf("orphaned() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
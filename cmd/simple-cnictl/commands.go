@@ -0,0 +1,328 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kerolt/simple-cni/pkg/bridge"
+	"github.com/kerolt/simple-cni/pkg/config"
+	"github.com/kerolt/simple-cni/pkg/ipam"
+	"github.com/kerolt/simple-cni/pkg/store"
+
+	cip "github.com/containernetworking/plugins/pkg/ip"
+)
+
+// diff 中每个 IP 的状态
+const (
+	statusOK        = "ok"        // store 中有记录且节点上有对应的接口
+	statusStale     = "stale"     // store 中有记录但节点上找不到对应的接口
+	statusUntracked = "untracked" // 节点上的接口在使用但 store 中没有记录
+	statusUnknown   = "unknown"   // 网桥上的 veth 无法关联到任何 IP
+)
+
+func runList(o *options, args []string) error {
+	if err := o.parse(args); err != nil {
+		return err
+	}
+
+	im, _, err := openIPAM(o)
+	if err != nil {
+		return err
+	}
+	defer im.Close()
+
+	entries, err := im.Allocations()
+	if err != nil {
+		return err
+	}
+
+	return o.print(entries, "IP\tCONTAINER\tIFNAME\tPOD\tNETNS\tALLOCATED", func(w *tabwriter.Writer) {
+		for _, e := range entries {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", e.IP, shortID(e.ContainerID), orDash(e.IfName), orDash(e.Pod()), orDash(e.Netns), formatTime(e.AllocatedAt))
+		}
+	})
+}
+
+func runStats(o *options, args []string) error {
+	if err := o.parse(args); err != nil {
+		return err
+	}
+
+	im, _, err := openIPAM(o)
+	if err != nil {
+		return err
+	}
+	defer im.Close()
+
+	u, err := im.Usage()
+	if err != nil {
+		return err
+	}
+
+	return o.print(u, "SUBNET\tRANGE\tTOTAL\tUSED\tRESERVED\tFREE\tOUT-OF-RANGE", func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "%s\t%s-%s\t%d\t%d\t%d\t%d\t%d\n", u.Subnet, u.RangeStart, u.RangeEnd, u.Total, u.Used, u.Reserved, u.Free, u.OutOfRange)
+	})
+}
+
+func runRelease(o *options, args []string) error {
+	var containerID, ifName, pod string
+	o.flags.StringVar(&containerID, "container", "", "Release the IPs of this container ID")
+	o.flags.StringVar(&pod, "pod", "", "Release the IPs of this pod (<namespace>/<name>)")
+	o.flags.StringVar(&ifName, "ifname", "", "Only release the IP of this interface")
+	if err := o.parse(args); err != nil {
+		return err
+	}
+	if (containerID == "") == (pod == "") {
+		return fmt.Errorf("exactly one of -container and -pod is required")
+	}
+
+	im, _, err := openIPAM(o)
+	if err != nil {
+		return err
+	}
+	defer im.Close()
+
+	released, err := im.ReleaseMatching(func(_ net.IP, alloc store.Allocation) bool {
+		if ifName != "" && alloc.IfName != ifName {
+			return false
+		}
+		if containerID != "" {
+			return alloc.ContainerID == containerID
+		}
+		return alloc.Pod() == pod
+	})
+	if err != nil {
+		return err
+	}
+	if len(released) == 0 {
+		return fmt.Errorf("no matching allocation")
+	}
+
+	ips := make([]string, 0, len(released))
+	for _, ip := range released {
+		ips = append(ips, ip.String())
+	}
+	return o.print(map[string][]string{"released": ips}, "RELEASED", func(w *tabwriter.Writer) {
+		for _, ip := range ips {
+			fmt.Fprintln(w, ip)
+		}
+	})
+}
+
+func runReserve(o *options, args []string) error {
+	var ipStr, pod, ifName string
+	var d time.Duration
+	o.flags.StringVar(&ipStr, "ip", "", "IP to reserve")
+	o.flags.StringVar(&pod, "pod", "", "Pod to reserve the IP for (<namespace>/<name>)")
+	o.flags.StringVar(&ifName, "ifname", "", "Interface of the pod, empty matches any interface")
+	o.flags.DurationVar(&d, "for", config.DefaultStickyGracePeriod, "How long to keep the reservation")
+	if err := o.parse(args); err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return fmt.Errorf("invalid IP %q", ipStr)
+	}
+
+	im, _, err := openIPAM(o)
+	if err != nil {
+		return err
+	}
+	defer im.Close()
+
+	if err := im.ReserveIP(ip, pod, ifName, d); err != nil {
+		return err
+	}
+
+	until := time.Now().Add(d).UTC()
+	return o.print(map[string]string{"ip": ip.String(), "pod": pod, "ifName": ifName, "until": until.Format(time.RFC3339)}, "IP\tPOD\tIFNAME\tUNTIL", func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", ip, pod, orDash(ifName), formatTime(until))
+	})
+}
+
+func runValidate(o *options, args []string) error {
+	if err := o.parse(args); err != nil {
+		return err
+	}
+
+	conf, err := loadConf(o.confFile)
+	if err != nil {
+		return err
+	}
+	s, err := openStore(conf)
+	if err != nil {
+		return err
+	}
+
+	problems := []string{}
+
+	// 先只读地检查数据文件，避免 LoadData 把损坏的文件当作需要恢复的数据改写掉
+	if fs, ok := s.(*store.Store); ok {
+		version, err := fs.Verify()
+		if err != nil {
+			s.Close()
+			return fmt.Errorf("data file is not usable: %w", err)
+		}
+		if version < store.SchemaVersion {
+			problems = append(problems, fmt.Sprintf("schema version %d is older than %d, it will be migrated on the next write", version, store.SchemaVersion))
+		}
+	}
+
+	im, err := ipam.NewIPAM(conf, s)
+	if err != nil {
+		s.Close()
+		return err
+	}
+	defer im.Close()
+
+	found, err := im.Validate()
+	if err != nil {
+		return err
+	}
+	problems = append(problems, found...)
+
+	if err := o.print(map[string][]string{"problems": problems}, "PROBLEM", func(w *tabwriter.Writer) {
+		for _, p := range problems {
+			fmt.Fprintln(w, p)
+		}
+	}); err != nil {
+		return err
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%d problems found", len(problems))
+	}
+	return nil
+}
+
+// diffEntry 是 diff 输出的一行
+type diffEntry struct {
+	IP          string `json:"ip,omitempty"`
+	Status      string `json:"status"`
+	Veth        string `json:"veth,omitempty"`
+	ContainerID string `json:"containerID,omitempty"`
+	Pod         string `json:"pod,omitempty"`
+}
+
+func runDiff(o *options, args []string) error {
+	var all bool
+	o.flags.BoolVar(&all, "all", false, "Also show IPs that are consistent")
+	if err := o.parse(args); err != nil {
+		return err
+	}
+
+	im, conf, err := openIPAM(o)
+	if err != nil {
+		return err
+	}
+	defer im.Close()
+
+	entries, err := im.Allocations()
+	if err != nil {
+		return err
+	}
+
+	// macvlan/ipvlan 模式下没有网桥，只比较网络命名空间中的地址
+	var ports []*bridge.Port
+	if conf.Mode == config.ModeBridge {
+		if ports, err = bridge.Ports(conf.Bridge); err != nil {
+			return fmt.Errorf("failed to list ports of bridge %s: %v", conf.Bridge, err)
+		}
+	}
+
+	// 节点上在使用的 IP：网桥端口后面的容器 IP，以及各个网络命名空间中配置的地址
+	subnet := im.Subnet()
+	live := make(map[string]string)
+	ips, err := bridge.LiveIPs(conf.Bridge, subnet)
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		live[ip.String()] = ""
+	}
+
+	var diff []diffEntry
+	for _, p := range ports {
+		known := false
+		for _, ip := range p.IPs {
+			if subnet.Contains(ip) {
+				live[ip.String()] = p.Name
+				known = true
+			}
+		}
+		if !known {
+			diff = append(diff, diffEntry{Status: statusUnknown, Veth: p.Name})
+		}
+	}
+
+	stored := make(map[string]bool)
+	for _, e := range entries {
+		stored[e.IP] = true
+		veth, ok := live[e.IP]
+		status := statusOK
+		if !ok {
+			status = statusStale
+		}
+		diff = append(diff, diffEntry{IP: e.IP, Status: status, Veth: veth, ContainerID: e.ContainerID, Pod: e.Pod()})
+	}
+	for ip, veth := range live {
+		if !stored[ip] {
+			diff = append(diff, diffEntry{IP: ip, Status: statusUntracked, Veth: veth})
+		}
+	}
+
+	shown := make([]diffEntry, 0, len(diff))
+	for _, d := range diff {
+		if all || d.Status != statusOK {
+			shown = append(shown, d)
+		}
+	}
+	sort.Slice(shown, func(i, j int) bool {
+		a, b := net.ParseIP(shown[i].IP), net.ParseIP(shown[j].IP)
+		if a == nil || b == nil {
+			return a != nil || (b == nil && shown[i].Veth < shown[j].Veth)
+		}
+		return cip.Cmp(a, b) < 0
+	})
+
+	if err := o.print(shown, "IP\tSTATUS\tVETH\tCONTAINER\tPOD", func(w *tabwriter.Writer) {
+		for _, d := range shown {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", orDash(d.IP), d.Status, orDash(d.Veth), shortID(d.ContainerID), orDash(d.Pod))
+		}
+	}); err != nil {
+		return err
+	}
+
+	for _, d := range shown {
+		if d.Status != statusOK {
+			return fmt.Errorf("store and bridge %s differ", conf.Bridge)
+		}
+	}
+	return nil
+}
+
+// shortID 截断容器 ID，便于表格显示
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return orDash(id)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.RFC3339)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/kerolt/simple-cni/pkg/store"
+)
+
+func runExport(o *options, args []string) error {
+	var out string
+	o.flags.StringVar(&out, "out", "-", "File to write the document to, - for stdout")
+	if err := o.parse(args); err != nil {
+		return err
+	}
+
+	conf, err := loadConf(o.confFile)
+	if err != nil {
+		return err
+	}
+	s, err := openStore(conf)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	doc, err := store.Export(s, conf.Name)
+	if err != nil {
+		return err
+	}
+
+	raw, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	raw = append(raw, '\n')
+	if out == "-" {
+		_, err = os.Stdout.Write(raw)
+		return err
+	}
+	return os.WriteFile(out, raw, 0600)
+}
+
+func runImport(o *options, args []string) error {
+	var in, hostLocal string
+	var opts store.ImportOptions
+	o.flags.StringVar(&in, "in", "", "Document written by export, - for stdin")
+	o.flags.StringVar(&hostLocal, "host-local", "", "host-local data directory to import, e.g. /var/lib/cni/networks/<network>")
+	o.flags.BoolVar(&opts.Force, "force", false, "Overwrite conflicting allocations with the imported ones")
+	o.flags.BoolVar(&opts.DryRun, "dry-run", false, "Only report what would be imported")
+	o.flags.BoolVar(&opts.IgnoreNetwork, "ignore-network", false, "Import a document exported from another network")
+	if err := o.parse(args); err != nil {
+		return err
+	}
+	if (in == "") == (hostLocal == "") {
+		return fmt.Errorf("exactly one of -in and -host-local is required")
+	}
+
+	var doc *store.Document
+	var err error
+	if hostLocal != "" {
+		doc, err = store.ReadHostLocal(hostLocal)
+		// host-local 的目录名就是它的网络名称，与 simple-cni 的网络名称不同是正常的
+		opts.IgnoreNetwork = true
+	} else {
+		doc, err = readDocument(in)
+	}
+	if err != nil {
+		return err
+	}
+
+	im, conf, err := openIPAM(o)
+	if err != nil {
+		return err
+	}
+	defer im.Close()
+
+	// 子网之外的 IP 不能导入，与当前配置的其他冲突（网关、被排除的地址等）可以在导入后用 validate 检查
+	opts.Subnet = im.Subnet()
+	result, err := store.Import(im.Store(), conf.Name, doc, opts)
+	if result != nil {
+		if perr := o.print(result, "IP\tCONFLICT", func(w *tabwriter.Writer) {
+			for _, c := range result.Conflicts {
+				fmt.Fprintf(w, "%s\t%s\n", c.IP, c.Reason)
+			}
+			fmt.Fprintf(w, "\nimported: %d, skipped: %d, reserved: %d\n", result.Imported, result.Skipped, result.Reserved)
+		}); perr != nil {
+			return perr
+		}
+	}
+	if errors.Is(err, store.ErrImportConflict) {
+		return fmt.Errorf("%w, use -force to overwrite", err)
+	}
+	return err
+}
+
+// readDocument 读取 export 写出的文档
+func readDocument(file string) (*store.Document, error) {
+	var raw []byte
+	var err error
+	if file == "-" {
+		raw, err = io.ReadAll(os.Stdin)
+	} else {
+		raw, err = os.ReadFile(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	doc := &store.Document{}
+	if err := json.Unmarshal(raw, doc); err != nil {
+		return nil, fmt.Errorf("invalid document %s: %v", file, err)
+	}
+	return doc, nil
+}
@@ -0,0 +1,187 @@
+// simple-cnictl 是在节点上查看与修复 simple-cni IPAM 状态的命令行工具
+//
+// 它读取与插件相同的网络配置与子网配置，通过 pkg/store 与 pkg/ipam 访问分配记录，
+// 因此与插件共用文件锁，可以在节点正常运行时使用。
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/kerolt/simple-cni/pkg/config"
+	"github.com/kerolt/simple-cni/pkg/ipam"
+	"github.com/kerolt/simple-cni/pkg/store"
+)
+
+const (
+	defaultConfFile = "/etc/cni/net.d/00-simplecni.conf"
+	pluginType      = "simple-cni"
+
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+// command 是一个子命令
+type command struct {
+	name  string
+	usage string
+	run   func(o *options, args []string) error
+}
+
+var commands = []*command{
+	{name: "list", usage: "List allocations", run: runList},
+	{name: "stats", usage: "Show free/used address counts", run: runStats},
+	{name: "release", usage: "Release the IPs of a container or pod", run: runRelease},
+	{name: "reserve", usage: "Reserve an IP for a pod", run: runReserve},
+	{name: "validate", usage: "Validate the data file against the network config", run: runValidate},
+	{name: "diff", usage: "Diff the store against live veths on the bridge", run: runDiff},
+	{name: "export", usage: "Export the allocation data to a portable document", run: runExport},
+	{name: "import", usage: "Import an exported document or a host-local data directory", run: runImport},
+}
+
+// options 是所有子命令共用的参数
+type options struct {
+	confFile string
+	output   string
+	flags    *flag.FlagSet
+}
+
+func newOptions(name string) *options {
+	o := &options{flags: flag.NewFlagSet(name, flag.ExitOnError)}
+	o.flags.StringVar(&o.confFile, "conf", defaultConfFile, "CNI network config file (.conf or .conflist)")
+	o.flags.StringVar(&o.output, "o", outputTable, "Output format: table or json")
+	return o
+}
+
+func (o *options) parse(args []string) error {
+	if err := o.flags.Parse(args); err != nil {
+		return err
+	}
+	if o.output != outputTable && o.output != outputJSON {
+		return fmt.Errorf("unknown output format %q", o.output)
+	}
+	return nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: simple-cnictl <command> [flags]\n\nCommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", c.name, c.usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun 'simple-cnictl <command> -h' for the flags of a command.\n")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	for _, c := range commands {
+		if c.name != os.Args[1] {
+			continue
+		}
+		if err := c.run(newOptions(c.name), os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if os.Args[1] != "-h" && os.Args[1] != "help" {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", os.Args[1])
+	}
+	usage()
+	os.Exit(2)
+}
+
+// loadConf 读取网络配置并合并子网配置，.conflist 中使用 type 为 simple-cni 的插件
+func loadConf(file string) (*config.CNIConf, error) {
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	list := struct {
+		Name       string            `json:"name"`
+		CNIVersion string            `json:"cniVersion"`
+		Plugins    []json.RawMessage `json:"plugins"`
+	}{}
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return nil, fmt.Errorf("invalid network config %s: %v", file, err)
+	}
+
+	if list.Plugins != nil {
+		raw, err = findPlugin(list.Name, list.CNIVersion, list.Plugins)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+	}
+
+	return config.LoadCNIConfig(raw, "")
+}
+
+// findPlugin 从 conflist 中找到 simple-cni 插件的配置，并补上网络名称与版本
+func findPlugin(name, cniVersion string, plugins []json.RawMessage) ([]byte, error) {
+	for _, p := range plugins {
+		conf := make(map[string]any)
+		if err := json.Unmarshal(p, &conf); err != nil {
+			return nil, err
+		}
+		if conf["type"] != pluginType {
+			continue
+		}
+		conf["name"] = name
+		conf["cniVersion"] = cniVersion
+		return json.Marshal(conf)
+	}
+	return nil, fmt.Errorf("no %s plugin in config list", pluginType)
+}
+
+// openStore 按网络配置打开 store
+func openStore(conf *config.CNIConf) (store.Backend, error) {
+	return store.New(store.Options{
+		Kind:       conf.Store,
+		Dir:        conf.DataDir,
+		Network:    conf.Name,
+		Kubeconfig: conf.Kubeconfig,
+		Node:       conf.Node,
+	})
+}
+
+// openIPAM 读取网络配置并创建 IPAM，调用方负责 Close
+func openIPAM(o *options) (*ipam.IPAM, *config.CNIConf, error) {
+	conf, err := loadConf(o.confFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s, err := openStore(conf)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	im, err := ipam.NewIPAM(conf, s)
+	if err != nil {
+		s.Close()
+		return nil, nil, err
+	}
+	return im, conf, nil
+}
+
+// print 按输出格式打印 v，表格格式时调用 table 写入每一行
+func (o *options) print(v any, header string, table func(w *tabwriter.Writer)) error {
+	if o.output == outputJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, header)
+	table(w)
+	return w.Flush()
+}
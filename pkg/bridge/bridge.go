@@ -1,43 +1,111 @@
 package bridge
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"log"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"syscall"
 
+	cnitypes "github.com/containernetworking/cni/pkg/types"
 	types "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
 	"github.com/vishvananda/netlink"
 )
 
-// CreateBridge 创建网桥设备
-func CreateBridge(bridgeName string, mtu int, gateway *net.IPNet) (netlink.Link, error) {
-	// 如果名称为 bridgeName 的设备已经存在，直接返回它
-	if link, _ := netlink.LinkByName(bridgeName); link != nil {
-		return link, nil
-	}
+// NetnsDir 是容器运行时（containerd、CRI-O）存放命名网络命名空间的目录
+const NetnsDir = "/var/run/netns"
+
+// maxLinkNameLen 是内核中网卡名称的最大长度（IFNAMSIZ - 1）
+const maxLinkNameLen = 15
+
+// HostVethName 返回容器 containerID 的 ifName 接口对应的宿主机端 veth 名称
+//
+// 名称由 prefix 加上 containerID 与 ifName 的哈希组成，同一个容器接口总是得到相同的名称，
+// 不进入容器网络命名空间也能找到它。prefix 的长度需要给哈希留出足够的字符（见 config 中的校验）
+func HostVethName(prefix, containerID, ifName string) string {
+	sum := sha256.Sum256([]byte(containerID + "/" + ifName))
+	return prefix + hex.EncodeToString(sum[:])[:maxLinkNameLen-len(prefix)]
+}
 
-	bridge := &netlink.Bridge{
-		LinkAttrs: netlink.LinkAttrs{
-			Name:   bridgeName,
-			MTU:    mtu,
-			TxQLen: -1,
-		},
+// BridgeConf 网桥的配置
+type BridgeConf struct {
+	Name    string
+	MTU     int
+	Gateway *net.IPNet // 网桥上配置的网关地址
+	// PromiscMode 开启网桥的混杂模式，网桥会收到目的 MAC 不是自己的帧，供抓包与依赖此行为的网络策略使用。
+	// 为 false 时不会关闭已经开启的混杂模式
+	PromiscMode bool
+	// VlanFiltering 开启网桥的 VLAN 过滤，为 false 时不会关闭已经开启的过滤
+	VlanFiltering bool
+	// Vlan 不为 0 时网关地址配置在网桥的 VLAN 子接口（见 VlanIfName）上，而不是网桥本身
+	Vlan int
+	// Uplink 以 trunk 方式接入网桥、带着 Vlan 标签的宿主机网卡
+	Uplink string
+}
+
+// GatewayLink 返回配置网关地址的设备名称：网桥本身，或者网桥的 VLAN 子接口
+func (c *BridgeConf) GatewayLink() string {
+	if c.Vlan != 0 {
+		return VlanIfName(c.Name, c.Vlan)
 	}
+	return c.Name
+}
 
-	// 尝试添加设备
-	if err := netlink.LinkAdd(bridge); err != nil && err != syscall.EEXIST {
+// CreateBridge 创建网桥设备，设备已经存在时将其调整为期望的状态
+//
+// 已有的设备可能是同名的其他类型设备、处于 down 状态、MTU 不对，或者还带着同一子网中之前的网关地址，
+// 这里会校验设备类型、设置 MTU、替换过期的网关地址并启动设备，多次调用的结果相同
+func CreateBridge(conf *BridgeConf) (netlink.Link, error) {
+	link, err := ensureBridge(conf.Name, conf.MTU)
+	if err != nil {
 		return nil, err
 	}
 
+	if link.Attrs().MTU != conf.MTU {
+		if err := netlink.LinkSetMTU(link, conf.MTU); err != nil {
+			return nil, fmt.Errorf("failed to set MTU of bridge %s to %d: %v", conf.Name, conf.MTU, err)
+		}
+	}
+
+	if conf.VlanFiltering {
+		if err := ensureVlanFiltering(link); err != nil {
+			return nil, err
+		}
+	}
+
 	// 将设备作为网关添加 IP 地址
-	link, err := netlink.LinkByName(bridgeName)
-	if err != nil {
-		return nil, err
+	gwLink := link
+	if conf.Vlan != 0 {
+		if gwLink, err = ensureVlanIf(link, conf.Vlan, conf.MTU); err != nil {
+			return nil, err
+		}
+		// 网关只能在 VLAN 子接口上，网桥本身上的同一地址会产生重复的直连路由，宿主机发往容器的报文可能从默认 VLAN 发出
+		if err := netlink.AddrDel(link, &netlink.Addr{IPNet: conf.Gateway}); err != nil && err != syscall.EADDRNOTAVAIL {
+			return nil, fmt.Errorf("failed to remove gateway %s from bridge %s: %v", conf.Gateway, conf.Name, err)
+		}
 	}
-	if err := netlink.AddrAdd(link, &netlink.Addr{IPNet: gateway}); err != nil {
-		return nil, err
+	if err := ensureGateway(gwLink, conf.Gateway); err != nil {
+		return nil, fmt.Errorf("failed to set gateway %s on %s: %v", conf.Gateway, gwLink.Attrs().Name, err)
+	}
+
+	if conf.Uplink != "" {
+		if err := attachUplink(link, conf.Uplink, conf.Vlan); err != nil {
+			return nil, err
+		}
+	}
+
+	if conf.PromiscMode && link.Attrs().Promisc == 0 {
+		if err := netlink.SetPromiscOn(link); err != nil {
+			return nil, fmt.Errorf("failed to set promiscuous mode on bridge %s: %v", conf.Name, err)
+		}
 	}
 
 	// 启动设备，等价于 ip link set br0 up
@@ -45,41 +113,248 @@ func CreateBridge(bridgeName string, mtu int, gateway *net.IPNet) (netlink.Link,
 		return nil, err
 	}
 
+	return netlink.LinkByName(conf.Name)
+}
+
+// CheckBridge 检查网桥是否存在、处于 up 状态，并且按配置开启了混杂模式与 VLAN 过滤
+func CheckBridge(conf *BridgeConf) error {
+	link, err := netlink.LinkByName(conf.Name)
+	if err != nil {
+		return err
+	}
+	if _, ok := link.(*netlink.Bridge); !ok {
+		return fmt.Errorf("link %s is a %s, not a bridge", conf.Name, link.Type())
+	}
+	if link.Attrs().Flags&net.FlagUp == 0 {
+		return fmt.Errorf("bridge %s is down", conf.Name)
+	}
+	if conf.PromiscMode && link.Attrs().Promisc == 0 {
+		return fmt.Errorf("bridge %s is not in promiscuous mode", conf.Name)
+	}
+	if conf.VlanFiltering {
+		if b := link.(*netlink.Bridge); b.VlanFiltering == nil || !*b.VlanFiltering {
+			return fmt.Errorf("vlan filtering is not enabled on bridge %s", conf.Name)
+		}
+	}
+	return nil
+}
+
+// ensureBridge 返回名称为 bridgeName 的网桥，不存在时创建，同名设备不是网桥时返回错误
+func ensureBridge(bridgeName string, mtu int) (netlink.Link, error) {
+	link, err := netlink.LinkByName(bridgeName)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); !ok {
+			return nil, err
+		}
+
+		bridge := &netlink.Bridge{
+			LinkAttrs: netlink.LinkAttrs{
+				Name:   bridgeName,
+				MTU:    mtu,
+				TxQLen: -1,
+			},
+		}
+
+		// 尝试添加设备，并发的 ADD 可能已经创建了它
+		if err := netlink.LinkAdd(bridge); err != nil && err != syscall.EEXIST {
+			return nil, err
+		}
+
+		if link, err = netlink.LinkByName(bridgeName); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, ok := link.(*netlink.Bridge); !ok {
+		return nil, fmt.Errorf("link %s already exists but is a %s, not a bridge", bridgeName, link.Type())
+	}
 	return link, nil
 }
 
+// ensureGateway 确保网桥上的网关地址是 gateway，删除同一子网中其他的（过期的）网关地址
+//
+// 网关变化时先添加新的网关地址、再删除旧的地址，迁移过程中网桥上始终有可用的网关。
+// 不属于 gateway 所在子网的地址可能是共用网桥的其他网络的网关，不会被删除
+func ensureGateway(link netlink.Link, gateway *net.IPNet) error {
+	family := netlink.FAMILY_V4
+	if gateway.IP.To4() == nil {
+		family = netlink.FAMILY_V6
+	}
+
+	addrs, err := netlink.AddrList(link, family)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, addr := range addrs {
+		if addr.IP.Equal(gateway.IP) && bytes.Equal(addr.Mask, gateway.Mask) {
+			found = true
+		}
+	}
+	if !found {
+		// AddrReplace 在地址已存在时不会报错，并发的 ADD 同时添加也没有问题
+		if err := netlink.AddrReplace(link, &netlink.Addr{IPNet: gateway}); err != nil {
+			return err
+		}
+	}
+
+	// 同一子网中后添加的地址是次地址，删除主地址时内核默认会把次地址一并删除，需要改为提升为主地址
+	if family == netlink.FAMILY_V4 {
+		key := fmt.Sprintf("net.ipv4.conf.%s.promote_secondaries", strings.ReplaceAll(link.Attrs().Name, ".", "/"))
+		if _, err := sysctl.Sysctl(key, "1"); err != nil {
+			return err
+		}
+	}
+
+	subnet := &net.IPNet{IP: gateway.IP.Mask(gateway.Mask), Mask: gateway.Mask}
+	for _, addr := range addrs {
+		if addr.IP.Equal(gateway.IP) && bytes.Equal(addr.Mask, gateway.Mask) {
+			continue
+		}
+		if !subnet.Contains(addr.IP) {
+			continue
+		}
+		if err := netlink.AddrDel(link, &addr); err != nil && err != syscall.EADDRNOTAVAIL {
+			return fmt.Errorf("failed to remove stale address %s: %v", addr.IPNet, err)
+		}
+	}
+	return nil
+}
+
+// RemoveStaleBridge 在网桥 name 没有任何端口、且网桥或它的 VLAN 子接口上还带着子网变化之前的网关地址 previous 时删除网桥，
+// 返回网桥是否被删除。下一次 ADD 会按新的子网重新创建网桥
+//
+// previous 为 nil、网桥不存在或同名设备不是网桥时什么也不做。调用方需要持有与 ADD 相同的 store 锁，
+// 避免并发的 ADD 把 veth 接到正在被删除的网桥上
+func RemoveStaleBridge(name string, previous *net.IPNet) (bool, error) {
+	if previous == nil {
+		return false, nil
+	}
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return false, nil
+		}
+		return false, err
+	}
+	if _, ok := link.(*netlink.Bridge); !ok {
+		return false, nil
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		return false, err
+	}
+	index := link.Attrs().Index
+	stale := false
+	for _, l := range links {
+		if l.Attrs().MasterIndex == index {
+			return false, nil
+		}
+		if _, ok := l.(*netlink.Vlan); l.Attrs().Index != index && !(ok && l.Attrs().ParentIndex == index) {
+			continue
+		}
+		addrs, err := netlink.AddrList(l, netlink.FAMILY_ALL)
+		if err != nil {
+			return false, err
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(previous.IP) {
+				stale = true
+			}
+		}
+	}
+	if !stale {
+		return false, nil
+	}
+
+	if err := netlink.LinkDel(link); err != nil {
+		return false, fmt.Errorf("failed to delete stale bridge %s: %v", name, err)
+	}
+	return true, nil
+}
+
+// RemoveAddr 删除设备 name 上的地址 addr，设备或地址不存在时什么也不做
+func RemoveAddr(name string, addr *net.IPNet) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return err
+	}
+	if err := netlink.AddrDel(link, &netlink.Addr{IPNet: addr}); err != nil && err != syscall.EADDRNOTAVAIL {
+		return fmt.Errorf("failed to remove address %s from %s: %v", addr, name, err)
+	}
+	return nil
+}
+
+// VethConf 容器 veth 的配置，macvlan/ipvlan 子接口同样使用其中的接口名称、MTU、MAC、地址与网关
+type VethConf struct {
+	IfName   string // 容器内的接口名称
+	HostName string // 宿主机端 veth 的名称，为空时使用随机名称
+	MTU      int
+	MAC      string // 不为空时作为容器端 veth 的 MAC 地址
+	PodIP    *net.IPNet
+	Gateway  net.IP
+	// Routes 容器内额外添加的路由，其中有默认路由时不再添加指向 Gateway 的默认路由
+	Routes []*cnitypes.Route
+	// Tuning 容器内接口的 sysctl 与网卡参数，为 nil 时不修改
+	Tuning *Tuning
+	// HairpinMode 在宿主机端的网桥端口上开启 hairpin，网桥可以把帧从收到它的端口发回去，
+	// Pod 通过 Service 的 ClusterIP 访问到自己时需要开启
+	HairpinMode bool
+	// Vlan 不为 0 时宿主机端 veth 以它作为 PVID 并以 untagged 方式接入网桥，网桥需要开启 VLAN 过滤
+	Vlan int
+	// L3 宿主机端 veth 不接入网桥，而是通过指向它的主机路由与 proxy-ARP 三层转发，
+	// PodIP 应当是 /32 地址，容器内的默认路由以 onlink 方式指向 Gateway
+	L3 bool
+}
+
 // SetupVeth 创建并配置容器的 veth
 //  1. 在容器网络命名空间中创建一个 veth pair（一端在容器内，一端在宿主机）
 //  2. 为容器端 veth 配置 IP 地址（podIP）和默认路由（指向 gateway）
 //  3. 将宿主机端 veth 插入到指定的桥接设备 bridge 中（如 cni0）
 //  4. 实现容器 ↔ 宿主机 ↔ 外部网络的连通性
-func SetupVeth(netns ns.NetNS, bridge netlink.Link, mtu int, ifName string, podIP *net.IPNet, gateway net.IP) error {
+//
+// conf.L3 为 true 时不使用网桥（bridge 可以为 nil），改为在宿主机上添加指向 veth 的主机路由。
+// 返回容器端接口信息用于 CNI 结果
+func SetupVeth(netns ns.NetNS, bridge netlink.Link, conf *VethConf) (*types.Interface, error) {
+	// 删除同一个容器接口上一次失败的 ADD 留下的宿主机端 veth
+	if conf.HostName != "" {
+		if err := delStaleHostVeth(netns, conf.HostName); err != nil {
+			return nil, err
+		}
+	}
+
 	hostIf := &types.Interface{}
+	contIf := &types.Interface{Sandbox: netns.Path()}
 	err := netns.Do(func(hostNS ns.NetNS) error {
 		// 创建 veth pair，一根虚拟网线，一头在容器，一头在宿主机
-		hostVeth, containerVeth, err := ip.SetupVeth(ifName, mtu, "", hostNS)
+		hostVeth, containerVeth, err := ip.SetupVethWithName(conf.IfName, conf.HostName, conf.MTU, conf.MAC, hostNS)
 		if err != nil {
 			return err
 		}
 
 		hostIf.Name = hostVeth.Name
+		contIf.Name = containerVeth.Name
+		contIf.Mac = containerVeth.HardwareAddr.String()
 
-		// 为 container veth 设置 IP
+		// 为 container veth 设置 sysctl 与网卡参数、IP 并启动
 		containerLink, err := netlink.LinkByName(containerVeth.Name)
 		if err != nil {
 			return err
 		}
-		if err := netlink.AddrAdd(containerLink, &netlink.Addr{IPNet: podIP}); err != nil {
+		if err := applyTuning(containerLink, conf.Tuning); err != nil {
 			return err
 		}
-
-		// 设置容器的 veth 为 up 状态
-		if err := netlink.LinkSetUp(containerLink); err != nil {
+		if err := setupAddr(containerLink, conf.PodIP); err != nil {
 			return err
 		}
 
 		// 设置路由
-		if err := ip.AddDefaultRoute(gateway, containerLink); err != nil {
+		if err := addRoutes(containerLink, conf, false); err != nil {
 			return err
 		}
 
@@ -87,26 +362,129 @@ func SetupVeth(netns ns.NetNS, bridge netlink.Link, mtu int, ifName string, podI
 	})
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// 宿主机侧的 veth = 接入点，通常会接到一个 bridge 上
 	hostVeth, err := netlink.LinkByName(hostIf.Name)
 	if err != nil {
-		return fmt.Errorf("failed to lookup %q: %v", hostIf.Name, err)
+		return nil, fmt.Errorf("failed to lookup %q: %v", hostIf.Name, err)
 	}
 	if hostVeth == nil {
-		return fmt.Errorf("host veth is null")
+		return nil, fmt.Errorf("host veth is null")
+	}
+
+	// l3 模式下容器没有二层邻居，不需要通告 MAC
+	if conf.L3 {
+		if err := setupHostRoute(hostVeth, conf.PodIP.IP); err != nil {
+			return nil, err
+		}
+		return contIf, nil
 	}
 
 	// 将主机 veth 与网桥连到一起
 	if err := netlink.LinkSetMaster(hostVeth, bridge); err != nil {
-		return fmt.Errorf("failed to connect %q to bridge %v: %v", hostVeth.Attrs().Name, bridge.Attrs().Name, err)
+		return nil, fmt.Errorf("failed to connect %q to bridge %v: %v", hostVeth.Attrs().Name, bridge.Attrs().Name, err)
 	}
 
+	// hairpin 与 VLAN 是网桥端口的属性，只能在接入网桥之后设置
+	if conf.Vlan != 0 {
+		if err := setPortVlan(hostVeth, conf.Vlan); err != nil {
+			return nil, err
+		}
+	}
+	if conf.HairpinMode {
+		if err := netlink.LinkSetHairpin(hostVeth, true); err != nil {
+			return nil, fmt.Errorf("failed to enable hairpin mode on %q: %v", hostVeth.Attrs().Name, err)
+		}
+	}
+
+	// 接入网桥之后再通告容器的 MAC，否则报文到不了网桥上的其他设备。通告失败只会让邻居缓存晚一些更新，不影响 ADD
+	if err := netns.Do(func(ns.NetNS) error {
+		return announce(conf.IfName, conf.PodIP.IP)
+	}); err != nil {
+		log.Printf("WARNING: failed to announce %s on %s: %v", conf.PodIP.IP, conf.IfName, err)
+	}
+
+	return contIf, nil
+}
+
+// setupAddr 为容器内的接口配置 IP 并将其设置为 up 状态
+func setupAddr(link netlink.Link, podIP *net.IPNet) error {
+	if err := netlink.AddrAdd(link, &netlink.Addr{IPNet: podIP}); err != nil {
+		return err
+	}
+	return netlink.LinkSetUp(link)
+}
+
+// addRoutes 在容器内添加默认路由与 conf.Routes 中的路由
+//
+// deviceDefault 为 true 时默认路由直接指向接口而不经过网关。conf.Routes 中有默认路由时，以它为准。
+// conf.L3 为 true 时容器内只有 /32 地址，没有到网关的直连路由，经过网关的路由都以 onlink 方式添加
+func addRoutes(link netlink.Link, conf *VethConf, deviceDefault bool) error {
+	var flags int
+	if conf.L3 {
+		flags = int(netlink.FLAG_ONLINK)
+	}
+
+	hasDefault := false
+	for _, r := range conf.Routes {
+		if ones, _ := r.Dst.Mask.Size(); ones == 0 {
+			hasDefault = true
+		}
+	}
+
+	if !hasDefault {
+		var err error
+		switch {
+		case deviceDefault:
+			err = netlink.RouteAdd(&netlink.Route{LinkIndex: link.Attrs().Index, Scope: netlink.SCOPE_LINK})
+		case conf.L3:
+			err = netlink.RouteAdd(&netlink.Route{LinkIndex: link.Attrs().Index, Gw: conf.Gateway, Flags: flags})
+		default:
+			err = ip.AddDefaultRoute(conf.Gateway, link)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to add default route: %v", err)
+		}
+	}
+
+	for _, r := range conf.Routes {
+		dst := r.Dst
+		route := &netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst:       &dst,
+			Gw:        r.GW,
+			Priority:  r.Priority,
+			MTU:       r.MTU,
+		}
+		// 没有下一跳的路由直接经过接口到达目的网段
+		if r.GW == nil {
+			route.Scope = netlink.SCOPE_LINK
+		} else {
+			route.Flags = flags
+		}
+		if err := netlink.RouteAdd(route); err != nil {
+			return fmt.Errorf("failed to add route %s: %v", r, err)
+		}
+	}
 	return nil
 }
 
+// checkAddr 检查容器内的接口是否配置了 conf.PodIP
+func checkAddr(link netlink.Link, conf *VethConf) error {
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if addr.IP.Equal(conf.PodIP.IP) {
+			return nil
+		}
+	}
+	return fmt.Errorf("failed to find ip %s for %s", conf.PodIP.IP, conf.IfName)
+}
+
 // DelVeth 删除指定的 veth。对于 veth pair，删除其中一端时，内核会自动清理另一端。
 func DelVeth(netns ns.NetNS, ifName string) error {
 	return netns.Do(func(ns.NetNS) error {
@@ -118,25 +496,196 @@ func DelVeth(netns ns.NetNS, ifName string) error {
 	})
 }
 
-// CheckVeth 检查容器内的 veth 是否存在且配置了指定的 IP
-func CheckVeth(netns ns.NetNS, ifName string, ip net.IP) error {
-	return netns.Do(func(ns.NetNS) error {
-		link, err := netlink.LinkByName(ifName)
+// DelHostVeth 在宿主机上删除名称为 name、另一端位于 netns 中的 veth，内核会一并删除容器内的另一端
+//
+// 宿主机端的名称是容器 ID 与接口名称的哈希，同名的设备不是 veth、或者它的另一端不在 netns 中时可能属于其他 Pod，
+// 这时与 veth 不存在一样返回 false，由调用方在 netns 中按接口名称删除
+func DelHostVeth(netns ns.NetNS, name string) (bool, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return false, nil
+		}
+		return false, err
+	}
+	veth, ok := link.(*netlink.Veth)
+	if !ok {
+		return false, nil
+	}
+	owned, err := vethPeerIn(netns, veth)
+	if err != nil || !owned {
+		return false, err
+	}
+	if err := netlink.LinkDel(link); err != nil {
+		return false, fmt.Errorf("failed to delete host veth %s: %v", name, err)
+	}
+	return true, nil
+}
+
+// delStaleHostVeth 删除宿主机上名为 name、另一端位于 netns 中的 veth，veth 不存在时什么也不做
+//
+// 与 DelHostVeth 相同，同名设备不是 veth、或者它的另一端不在 netns 中时不删除，而是返回错误
+func delStaleHostVeth(netns ns.NetNS, name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return err
+	}
+	veth, ok := link.(*netlink.Veth)
+	if !ok {
+		return fmt.Errorf("link %s already exists and is a %s, not a veth", name, link.Type())
+	}
+	owned, err := vethPeerIn(netns, veth)
+	if err != nil {
+		return err
+	}
+	if !owned {
+		return fmt.Errorf("host veth %s already exists and its peer is not in %s, the name may collide with another pod's veth", name, netns.Path())
+	}
+
+	if err := netlink.LinkDel(link); err != nil {
+		return fmt.Errorf("failed to delete host veth %s: %v", name, err)
+	}
+	return nil
+}
+
+// vethPeerIn 判断宿主机端 veth 的另一端是否在 netns 中、且它的 peer 正是这个 veth，即两端属于同一个容器接口
+func vethPeerIn(netns ns.NetNS, veth *netlink.Veth) (bool, error) {
+	peerIndex, err := netlink.VethPeerIndex(veth)
+	if err != nil {
+		return false, fmt.Errorf("failed to get the peer of %s: %v", veth.Attrs().Name, err)
+	}
+
+	owned := false
+	err = netns.Do(func(ns.NetNS) error {
+		peer, err := netlink.LinkByIndex(peerIndex)
 		if err != nil {
+			if _, ok := err.(netlink.LinkNotFoundError); ok {
+				return nil
+			}
 			return err
 		}
+		if peerVeth, ok := peer.(*netlink.Veth); ok {
+			index, err := netlink.VethPeerIndex(peerVeth)
+			owned = err == nil && index == veth.Attrs().Index
+		}
+		return nil
+	})
+	return owned, err
+}
 
-		addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+// CheckVeth 检查容器内的 veth 是否存在且配置了指定的 IP，以及宿主机端的 veth 是否接在网桥上并按配置开启了 hairpin、加入了 VLAN
+//
+// conf.L3 为 true 时改为检查宿主机端 veth 的 proxy-ARP 与主机路由，bridgeName 不使用
+func CheckVeth(netns ns.NetNS, bridgeName string, conf *VethConf) error {
+	var peerIndex int
+	err := netns.Do(func(ns.NetNS) error {
+		link, err := netlink.LinkByName(conf.IfName)
 		if err != nil {
 			return err
 		}
 
-		for _, addr := range addrs {
-			if addr.IP.Equal(ip) {
-				return nil
-			}
+		if err := checkAddr(link, conf); err != nil {
+			return err
 		}
 
-		return fmt.Errorf("failed to find ip %s for %s", ip, ifName)
+		// 通过容器端 veth 记录的对端 ifindex 找到宿主机端 veth，旧版本创建的 veth 名称是随机的
+		_, peerIndex, err = ip.GetVethPeerIfindex(conf.IfName)
+		return err
 	})
+	if err != nil {
+		return err
+	}
+
+	if conf.L3 {
+		return checkHostRoute(peerIndex, conf.PodIP.IP)
+	}
+	return checkPort(peerIndex, bridgeName, conf)
+}
+
+// checkPort 检查 ifindex 为 index 的宿主机端 veth 是否是网桥 bridgeName 的端口，
+// 并按 conf 检查端口是否开启了 hairpin、是否以 untagged 方式加入了 VLAN
+func checkPort(index int, bridgeName string, conf *VethConf) error {
+	br, err := netlink.LinkByName(bridgeName)
+	if err != nil {
+		return err
+	}
+
+	link, err := netlink.LinkByIndex(index)
+	if err != nil {
+		return fmt.Errorf("failed to find host veth with index %d: %v", index, err)
+	}
+	name := link.Attrs().Name
+	if link.Attrs().MasterIndex != br.Attrs().Index {
+		return fmt.Errorf("host veth %s is not attached to bridge %s", name, bridgeName)
+	}
+
+	if conf.Vlan != 0 {
+		if err := checkPortVlan(index, conf.Vlan, name); err != nil {
+			return err
+		}
+	}
+
+	if !conf.HairpinMode {
+		return nil
+	}
+	protinfo, err := netlink.LinkGetProtinfo(link)
+	if err != nil {
+		return fmt.Errorf("failed to get bridge port info of %s: %v", name, err)
+	}
+	if !protinfo.Hairpin {
+		return fmt.Errorf("hairpin mode is not enabled on host veth %s", name)
+	}
+	return nil
+}
+
+// LiveIPs 收集节点上仍在使用、且属于 subnet 的容器 IP，用于 store 损坏后重建分配记录
+//
+// IP 来源包括网桥上的邻居表项以及 NetnsDir 下各个网络命名空间中配置的地址
+func LiveIPs(bridgeName string, subnet *net.IPNet) ([]net.IP, error) {
+	seen := make(map[string]net.IP)
+
+	if br, err := netlink.LinkByName(bridgeName); err == nil {
+		neighs, err := netlink.NeighList(br.Attrs().Index, netlink.FAMILY_ALL)
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range neighs {
+			if n.IP != nil && subnet.Contains(n.IP) {
+				seen[n.IP.String()] = n.IP
+			}
+		}
+	}
+
+	entries, err := os.ReadDir(NetnsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, entry := range entries {
+		netns, err := ns.GetNS(filepath.Join(NetnsDir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		_ = netns.Do(func(ns.NetNS) error {
+			addrs, err := netlink.AddrList(nil, netlink.FAMILY_ALL)
+			if err != nil {
+				return err
+			}
+			for _, addr := range addrs {
+				if subnet.Contains(addr.IP) {
+					seen[addr.IP.String()] = addr.IP
+				}
+			}
+			return nil
+		})
+		netns.Close()
+	}
+
+	ips := make([]net.IP, 0, len(seen))
+	for _, ip := range seen {
+		ips = append(ips, ip)
+	}
+	return ips, nil
 }
@@ -0,0 +1,137 @@
+package bridge
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// announce 从接口 ifName 上通告 ip 对应的 MAC 地址：IPv4 发送免费 ARP，IPv6 发送主动的邻居通告（NA）
+//
+// IP 被释放后很快会分配给新的容器，网桥上的其他容器与宿主机可能还缓存着旧容器的 MAC，
+// 在缓存过期之前发往这个 IP 的报文都会丢失。需要在容器网络命名空间中、接口接入网桥并启动之后调用
+func announce(ifName string, ip net.IP) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return err
+	}
+	mac := link.Attrs().HardwareAddr
+	if len(mac) != 6 {
+		return fmt.Errorf("interface %s has no ethernet address", ifName)
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return sendFrame(link.Attrs().Index, unix.ETH_P_ARP, broadcastMAC, garpFrame(mac, ip4))
+	}
+	return sendFrame(link.Attrs().Index, unix.ETH_P_IPV6, allNodesMAC, unsolicitedNAFrame(mac, ip.To16()))
+}
+
+var (
+	broadcastMAC = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	allNodesMAC  = net.HardwareAddr{0x33, 0x33, 0x00, 0x00, 0x00, 0x01} // ff02::1 对应的组播 MAC
+	allNodesIP   = net.ParseIP("ff02::1")
+)
+
+// garpFrame 构造免费 ARP 请求（不含以太网头），发送方与目标 IP 都是 ip
+func garpFrame(mac net.HardwareAddr, ip net.IP) []byte {
+	b := make([]byte, 28)
+	binary.BigEndian.PutUint16(b[0:], 1)      // 硬件类型：以太网
+	binary.BigEndian.PutUint16(b[2:], 0x0800) // 协议类型：IPv4
+	b[4], b[5] = 6, 4
+	binary.BigEndian.PutUint16(b[6:], 1) // 操作码：请求
+	copy(b[8:], mac)
+	copy(b[14:], ip)
+	copy(b[24:], ip) // 目标 MAC 保持全 0
+	return b
+}
+
+// unsolicitedNAFrame 构造发往 ff02::1 的主动邻居通告（含 IPv6 头，不含以太网头），带上目标链路层地址选项并设置 Override 标志
+func unsolicitedNAFrame(mac net.HardwareAddr, ip net.IP) []byte {
+	icmp := make([]byte, 32)
+	icmp[0] = 136                                    // 类型：邻居通告
+	binary.BigEndian.PutUint32(icmp[4:], 0x20000000) // 标志：Override
+	copy(icmp[8:], ip)
+	icmp[24], icmp[25] = 2, 1 // 选项：目标链路层地址，长度 8 字节
+	copy(icmp[26:], mac)
+
+	b := make([]byte, 40+len(icmp))
+	b[0] = 6 << 4
+	binary.BigEndian.PutUint16(b[4:], uint16(len(icmp)))
+	b[6] = unix.IPPROTO_ICMPV6
+	b[7] = 255 // 邻居发现报文的跳数限制必须是 255
+	copy(b[8:], ip)
+	copy(b[24:], allNodesIP)
+	copy(b[40:], icmp)
+
+	binary.BigEndian.PutUint16(b[42:], icmpv6Checksum(ip, allNodesIP, icmp))
+	return b
+}
+
+// icmpv6Checksum 计算包含 IPv6 伪首部的 ICMPv6 校验和
+func icmpv6Checksum(src, dst net.IP, msg []byte) uint16 {
+	pseudo := make([]byte, 40, 40+len(msg))
+	copy(pseudo[0:], src.To16())
+	copy(pseudo[16:], dst.To16())
+	binary.BigEndian.PutUint32(pseudo[32:], uint32(len(msg)))
+	pseudo[39] = unix.IPPROTO_ICMPV6
+	pseudo = append(pseudo, msg...)
+
+	var sum uint32
+	for i := 0; i+1 < len(pseudo); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(pseudo[i:]))
+	}
+	if len(pseudo)%2 == 1 {
+		sum += uint32(pseudo[len(pseudo)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// sendFrame 通过 AF_PACKET socket 从 ifindex 为 index 的接口发送一个以太网帧，以太网头由内核填充
+func sendFrame(index int, proto uint16, dst net.HardwareAddr, payload []byte) error {
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM, int(htons(proto)))
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	addr := &unix.SockaddrLinklayer{Protocol: htons(proto), Ifindex: index, Halen: 6}
+	copy(addr.Addr[:], dst)
+	return unix.Sendto(fd, payload, 0, addr)
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+// FlushNeigh 删除宿主机在网桥 bridgeName 上为 ip 缓存的邻居表项，网桥不存在时什么也不做
+//
+// 释放 IP 时调用，IP 分配给新的容器后，宿主机会重新解析它的 MAC，而不是继续使用旧容器的 MAC
+func FlushNeigh(bridgeName string, ip net.IP) error {
+	br, err := netlink.LinkByName(bridgeName)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return err
+	}
+
+	neighs, err := netlink.NeighList(br.Attrs().Index, netlink.FAMILY_ALL)
+	if err != nil {
+		return err
+	}
+	for _, n := range neighs {
+		if !n.IP.Equal(ip) {
+			continue
+		}
+		if err := netlink.NeighDel(&n); err != nil && err != unix.ENOENT {
+			return fmt.Errorf("failed to delete neighbor %s on %s: %v", ip, bridgeName, err)
+		}
+	}
+	return nil
+}
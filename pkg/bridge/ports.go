@@ -0,0 +1,68 @@
+package bridge
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+// Port 是接在网桥上的一个宿主机端 veth
+type Port struct {
+	Name  string   `json:"name"`          // 宿主机端 veth 名称
+	Index int      `json:"index"`         // 宿主机端 veth 的 ifindex
+	MACs  []string `json:"macs"`          // 在该端口上学习到的容器 MAC 地址
+	IPs   []net.IP `json:"ips,omitempty"` // 通过网桥邻居表解析出的容器 IP，容器长时间没有流量时可能为空
+}
+
+// Ports 列出接在网桥上的 veth，并通过网桥转发表（FDB）与邻居表关联出每个端口后面的容器 MAC 与 IP
+func Ports(bridgeName string) ([]*Port, error) {
+	br, err := netlink.LinkByName(bridgeName)
+	if err != nil {
+		return nil, err
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+
+	// 邻居表：容器 IP -> MAC
+	neighs, err := netlink.NeighList(br.Attrs().Index, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, err
+	}
+	ipsByMAC := make(map[string][]net.IP)
+	for _, n := range neighs {
+		if n.IP == nil || n.HardwareAddr == nil || n.State&(netlink.NUD_FAILED|netlink.NUD_INCOMPLETE) != 0 {
+			continue
+		}
+		mac := n.HardwareAddr.String()
+		ipsByMAC[mac] = append(ipsByMAC[mac], n.IP)
+	}
+
+	var ports []*Port
+	for _, link := range links {
+		attrs := link.Attrs()
+		if attrs.MasterIndex != br.Attrs().Index || link.Type() != "veth" {
+			continue
+		}
+		port := &Port{Name: attrs.Name, Index: attrs.Index}
+
+		// 转发表：端口 -> 在该端口上学习到的 MAC，永久表项是端口自身的地址
+		fdb, err := netlink.NeighList(attrs.Index, syscall.AF_BRIDGE)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range fdb {
+			if f.HardwareAddr == nil || f.State&netlink.NUD_PERMANENT != 0 || f.LinkIndex != attrs.Index {
+				continue
+			}
+			mac := f.HardwareAddr.String()
+			port.MACs = append(port.MACs, mac)
+			port.IPs = append(port.IPs, ipsByMAC[mac]...)
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
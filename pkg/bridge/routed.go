@@ -0,0 +1,66 @@
+package bridge
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/vishvananda/netlink"
+)
+
+// setupHostRoute 为 l3 模式下的宿主机端 veth 开启 proxy-ARP，并添加指向它的容器 /32 主机路由
+//
+// 容器内只有 /32 地址，访问网关与其他地址时都会在 veth 上解析网关的 MAC，由宿主机以 veth 的 MAC 应答，
+// 报文全部经过宿主机的三层转发，容器之间没有共享的二层网络，无法互相 ARP 欺骗
+func setupHostRoute(hostVeth netlink.Link, podIP net.IP) error {
+	name := hostVeth.Attrs().Name
+	sysctlName := strings.ReplaceAll(name, ".", "/")
+
+	if _, err := sysctl.Sysctl(fmt.Sprintf("net.ipv4.conf.%s.proxy_arp", sysctlName), "1"); err != nil {
+		return fmt.Errorf("failed to enable proxy arp on %s: %v", name, err)
+	}
+	// 默认会随机延迟最多 0.8 秒再应答 proxy-ARP 请求，容器启动后的第一个连接会因此变慢
+	if _, err := sysctl.Sysctl(fmt.Sprintf("net.ipv4.neigh.%s.proxy_delay", sysctlName), "0"); err != nil {
+		return fmt.Errorf("failed to set proxy_delay on %s: %v", name, err)
+	}
+
+	route := &netlink.Route{
+		LinkIndex: hostVeth.Attrs().Index,
+		Dst:       &net.IPNet{IP: podIP, Mask: net.CIDRMask(len(podIP)*8, len(podIP)*8)},
+		Scope:     netlink.SCOPE_LINK,
+	}
+	if err := netlink.RouteReplace(route); err != nil {
+		return fmt.Errorf("failed to add host route %s via %s: %v", route.Dst, name, err)
+	}
+	return nil
+}
+
+// checkHostRoute 检查 ifindex 为 index 的宿主机端 veth 是否没有接入网桥、开启了 proxy-ARP，并且有指向它的 podIP 主机路由
+func checkHostRoute(index int, podIP net.IP) error {
+	link, err := netlink.LinkByIndex(index)
+	if err != nil {
+		return fmt.Errorf("failed to find host veth with index %d: %v", index, err)
+	}
+	name := link.Attrs().Name
+	if link.Attrs().MasterIndex != 0 {
+		return fmt.Errorf("host veth %s is attached to a bridge", name)
+	}
+
+	value, err := sysctl.Sysctl(fmt.Sprintf("net.ipv4.conf.%s.proxy_arp", strings.ReplaceAll(name, ".", "/")))
+	if err != nil {
+		return err
+	}
+	if value != "1" {
+		return fmt.Errorf("proxy arp is not enabled on host veth %s", name)
+	}
+
+	routes, err := netlink.RouteGet(podIP)
+	if err != nil {
+		return err
+	}
+	if len(routes) == 0 || routes[0].LinkIndex != index {
+		return fmt.Errorf("no host route to %s via host veth %s", podIP, name)
+	}
+	return nil
+}
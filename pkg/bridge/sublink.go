@@ -0,0 +1,224 @@
+package bridge
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+
+	types "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+// 子接口的类型，与 netlink 中的设备类型一致
+const (
+	KindMacvlan = "macvlan"
+	KindIPVlan  = "ipvlan"
+)
+
+// SubIfConf macvlan/ipvlan 子接口的配置
+//
+// 子接口直接挂在宿主机网卡上，容器的报文不经过网桥与宿主机的协议栈，延迟更低。
+// 与 veth 不同，宿主机本身无法通过父设备访问子接口，网关需要是父设备所在二层网络中的路由器
+type SubIfConf struct {
+	Kind   string // KindMacvlan 或 KindIPVlan
+	Master string // 父设备，为空时使用默认路由所在的网卡
+	L3     bool   // ipvlan 使用 l3 模式，容器的默认路由直接指向接口，不经过网关
+}
+
+// SetupSubIf 在父设备上创建 macvlan（bridge 模式）或 ipvlan 子接口，移入容器网络命名空间后配置地址与默认路由
+//
+// 返回容器端接口信息用于 CNI 结果
+func SetupSubIf(netns ns.NetNS, sub *SubIfConf, conf *VethConf) (*types.Interface, error) {
+	if sub.Kind == KindIPVlan && conf.MAC != "" {
+		return nil, fmt.Errorf("ipvlan interfaces share the MAC address of the master, a MAC address can not be requested")
+	}
+
+	master, err := masterLink(sub.Master)
+	if err != nil {
+		return nil, err
+	}
+
+	// 子接口的 MTU 不能大于父设备
+	mtu := conf.MTU
+	if mtu > master.Attrs().MTU {
+		mtu = master.Attrs().MTU
+	}
+
+	// 直接在容器网络命名空间中创建，先使用临时名称，避免与宿主机或容器中已有的设备重名
+	tmpName, err := tempLinkName()
+	if err != nil {
+		return nil, err
+	}
+	attrs := netlink.LinkAttrs{
+		Name:        tmpName,
+		MTU:         mtu,
+		ParentIndex: master.Attrs().Index,
+		Namespace:   netlink.NsFd(int(netns.Fd())),
+	}
+
+	var link netlink.Link
+	switch sub.Kind {
+	case KindMacvlan:
+		link = &netlink.Macvlan{LinkAttrs: attrs, Mode: netlink.MACVLAN_MODE_BRIDGE}
+	case KindIPVlan:
+		mode := netlink.IPVLAN_MODE_L2
+		if sub.L3 {
+			mode = netlink.IPVLAN_MODE_L3
+		}
+		link = &netlink.IPVlan{LinkAttrs: attrs, Mode: mode}
+	default:
+		return nil, fmt.Errorf("unknown sub-interface kind %q", sub.Kind)
+	}
+	if err := netlink.LinkAdd(link); err != nil {
+		return nil, fmt.Errorf("failed to create %s on %s: %v", sub.Kind, master.Attrs().Name, err)
+	}
+
+	contIf := &types.Interface{Name: conf.IfName, Sandbox: netns.Path()}
+	err = netns.Do(func(ns.NetNS) error {
+		if err := ip.RenameLink(tmpName, conf.IfName); err != nil {
+			if link, lerr := netlink.LinkByName(tmpName); lerr == nil {
+				netlink.LinkDel(link)
+			}
+			return fmt.Errorf("failed to rename %s to %s: %v", sub.Kind, conf.IfName, err)
+		}
+
+		if err := configureSubIf(sub, conf, contIf); err != nil {
+			// 配置失败时删除子接口，重试的 ADD 可以重新创建
+			if link, lerr := netlink.LinkByName(conf.IfName); lerr == nil {
+				netlink.LinkDel(link)
+			}
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return contIf, nil
+}
+
+// configureSubIf 在容器网络命名空间中为子接口设置 MAC、sysctl 与网卡参数、地址与默认路由，并把最终的 MAC 写入 contIf
+func configureSubIf(sub *SubIfConf, conf *VethConf, contIf *types.Interface) error {
+	containerLink, err := netlink.LinkByName(conf.IfName)
+	if err != nil {
+		return err
+	}
+
+	if conf.MAC != "" {
+		mac, err := net.ParseMAC(conf.MAC)
+		if err != nil {
+			return err
+		}
+		if err := netlink.LinkSetHardwareAddr(containerLink, mac); err != nil {
+			return fmt.Errorf("failed to set MAC address of %s: %v", conf.IfName, err)
+		}
+	}
+
+	if err := applyTuning(containerLink, conf.Tuning); err != nil {
+		return err
+	}
+	if err := setupAddr(containerLink, conf.PodIP); err != nil {
+		return err
+	}
+
+	// ipvlan l3 模式下父设备负责三层转发，容器内没有二层邻居，默认路由直接指向接口
+	if err := addRoutes(containerLink, conf, sub.L3); err != nil {
+		return err
+	}
+
+	// 重新读取设备，拿到最终的 MAC 地址
+	if containerLink, err = netlink.LinkByName(conf.IfName); err != nil {
+		return err
+	}
+	contIf.Mac = containerLink.Attrs().HardwareAddr.String()
+
+	// ipvlan l3 模式下没有 ARP，不需要通告
+	if !sub.L3 {
+		if err := announce(conf.IfName, conf.PodIP.IP); err != nil {
+			log.Printf("WARNING: failed to announce %s on %s: %v", conf.PodIP.IP, conf.IfName, err)
+		}
+	}
+	return nil
+}
+
+// DelSubIf 删除容器内的 macvlan/ipvlan 子接口，同名设备不是 kind 类型时返回错误，避免误删
+func DelSubIf(netns ns.NetNS, kind, ifName string) error {
+	return netns.Do(func(ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return err
+		}
+		if link.Type() != kind {
+			return fmt.Errorf("link %s is a %s, not a %s", ifName, link.Type(), kind)
+		}
+		return netlink.LinkDel(link)
+	})
+}
+
+// CheckSubIf 检查容器内的子接口是否存在、类型与模式是否符合配置，以及是否配置了指定的 IP
+func CheckSubIf(netns ns.NetNS, sub *SubIfConf, conf *VethConf) error {
+	return netns.Do(func(ns.NetNS) error {
+		link, err := netlink.LinkByName(conf.IfName)
+		if err != nil {
+			return err
+		}
+
+		switch l := link.(type) {
+		case *netlink.Macvlan:
+			if sub.Kind != KindMacvlan {
+				return fmt.Errorf("link %s is a macvlan, not a %s", conf.IfName, sub.Kind)
+			}
+			if l.Mode != netlink.MACVLAN_MODE_BRIDGE {
+				return fmt.Errorf("macvlan %s is not in bridge mode", conf.IfName)
+			}
+		case *netlink.IPVlan:
+			if sub.Kind != KindIPVlan {
+				return fmt.Errorf("link %s is an ipvlan, not a %s", conf.IfName, sub.Kind)
+			}
+			if l.Mode == netlink.IPVLAN_MODE_L3 != sub.L3 {
+				return fmt.Errorf("ipvlan %s is not in the configured mode", conf.IfName)
+			}
+		default:
+			return fmt.Errorf("link %s is a %s, not a %s", conf.IfName, link.Type(), sub.Kind)
+		}
+
+		return checkAddr(link, conf)
+	})
+}
+
+// masterLink 返回名称为 name 的父设备，name 为空时返回 IPv4 默认路由所在的网卡
+func masterLink(name string) (netlink.Link, error) {
+	if name != "" {
+		return netlink.LinkByName(name)
+	}
+
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range routes {
+		if r.Dst != nil {
+			if ones, _ := r.Dst.Mask.Size(); ones != 0 {
+				continue
+			}
+		}
+		if r.LinkIndex > 0 {
+			return netlink.LinkByIndex(r.LinkIndex)
+		}
+	}
+	return nil, fmt.Errorf("no default route found, set master in the network config")
+}
+
+// tempLinkName 返回创建子接口时使用的临时名称
+func tempLinkName() (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "tmp" + hex.EncodeToString(b), nil
+}
@@ -0,0 +1,77 @@
+package bridge
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/safchain/ethtool"
+	"github.com/vishvananda/netlink"
+)
+
+// IfNamePlaceholder 出现在 sysctl 的键中时会被替换为容器接口的名称
+const IfNamePlaceholder = "{ifName}"
+
+// Tuning 容器内接口的 sysctl 与网卡参数，在容器网络命名空间中设置
+type Tuning struct {
+	Sysctl        map[string]string // 键与值，调用方已经按白名单校验过
+	DisableIPv6RA bool              // 不接受 IPv6 路由通告，容器的地址与路由只由插件配置
+	TxQueueLen    int               // 发送队列长度，0 表示不修改
+	Offloads      map[string]bool   // 要开启或关闭的 ethtool 特性，如 tx-checksum-ip-generic、rx-gro
+	Promisc       bool              // 开启接口的混杂模式
+}
+
+// applyTuning 在当前（容器）网络命名空间中为 link 设置 t 中的参数，需要在 netns.Do 中调用
+//
+// 在接口启动之前调用，避免接口 up 之后、关闭 accept_ra 之前收到路由通告
+func applyTuning(link netlink.Link, t *Tuning) error {
+	if t == nil {
+		return nil
+	}
+	name := link.Attrs().Name
+
+	// 以 . 分隔的 sysctl 键中，接口名称里的 . 要写成 /（如 eth0.100 写成 eth0/100）
+	sysctlName := strings.ReplaceAll(name, ".", "/")
+
+	// /proc/sys/net 对应的是当前线程所在的网络命名空间
+	for key, value := range t.Sysctl {
+		key = strings.ReplaceAll(key, IfNamePlaceholder, sysctlName)
+		if _, err := sysctl.Sysctl(key, value); err != nil {
+			return fmt.Errorf("failed to set sysctl %s=%s: %v", key, value, err)
+		}
+	}
+
+	if t.DisableIPv6RA {
+		// 内核关闭了 IPv6 时不存在这个参数，也就不会接受路由通告
+		key := fmt.Sprintf("net.ipv6.conf.%s.accept_ra", sysctlName)
+		if _, err := sysctl.Sysctl(key, "0"); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to disable IPv6 router advertisements on %s: %v", name, err)
+		}
+	}
+
+	if t.TxQueueLen > 0 {
+		if err := netlink.LinkSetTxQLen(link, t.TxQueueLen); err != nil {
+			return fmt.Errorf("failed to set txqueuelen of %s to %d: %v", name, t.TxQueueLen, err)
+		}
+	}
+
+	if len(t.Offloads) > 0 {
+		// ethtool 的 socket 属于创建它时所在的网络命名空间，必须在容器网络命名空间中创建
+		e, err := ethtool.NewEthtool()
+		if err != nil {
+			return err
+		}
+		defer e.Close()
+		if err := e.Change(name, t.Offloads); err != nil {
+			return fmt.Errorf("failed to change offloads of %s: %v", name, err)
+		}
+	}
+
+	if t.Promisc {
+		if err := netlink.SetPromiscOn(link); err != nil {
+			return fmt.Errorf("failed to set promiscuous mode on %s: %v", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package bridge
+
+import (
+	"fmt"
+	"strconv"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+// defaultPVID 是网桥没有设置 vlan_default_pvid 时新端口所在的 VLAN
+const defaultPVID = 1
+
+// VlanIfName 返回网桥 bridgeName 上 VLAN vid 的子接口名称（<网桥>.<vid>），网关地址配置在这个接口上
+//
+// 名称超过网卡名称的最大长度时截断网桥名称
+func VlanIfName(bridgeName string, vid int) string {
+	suffix := "." + strconv.Itoa(vid)
+	if len(bridgeName)+len(suffix) > maxLinkNameLen {
+		bridgeName = bridgeName[:maxLinkNameLen-len(suffix)]
+	}
+	return bridgeName + suffix
+}
+
+// ensureVlanFiltering 开启网桥 br 的 VLAN 过滤，已经开启时什么也不做
+func ensureVlanFiltering(br netlink.Link) error {
+	if b, ok := br.(*netlink.Bridge); ok && b.VlanFiltering != nil && *b.VlanFiltering {
+		return nil
+	}
+	if err := netlink.BridgeSetVlanFiltering(br, true); err != nil {
+		return fmt.Errorf("failed to enable vlan filtering on bridge %s: %v", br.Attrs().Name, err)
+	}
+	return nil
+}
+
+// ensureVlanIf 返回网桥 br 上 VLAN vid 的子接口，不存在时创建，并让网桥自身以 tagged 方式加入 vid
+//
+// 网桥自身只能有一个 PVID，多个网络共用网桥时各自的网关地址只能放在各自的 VLAN 子接口上
+func ensureVlanIf(br netlink.Link, vid, mtu int) (netlink.Link, error) {
+	brName := br.Attrs().Name
+	if err := netlink.BridgeVlanAdd(br, uint16(vid), false, false, true, false); err != nil {
+		return nil, fmt.Errorf("failed to add vlan %d to bridge %s: %v", vid, brName, err)
+	}
+
+	name := VlanIfName(brName, vid)
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); !ok {
+			return nil, err
+		}
+		vlan := &netlink.Vlan{
+			LinkAttrs: netlink.LinkAttrs{Name: name, MTU: mtu, ParentIndex: br.Attrs().Index},
+			VlanId:    vid,
+		}
+		// 并发的 ADD 可能已经创建了它
+		if err := netlink.LinkAdd(vlan); err != nil && err != syscall.EEXIST {
+			return nil, fmt.Errorf("failed to create vlan interface %s: %v", name, err)
+		}
+		if link, err = netlink.LinkByName(name); err != nil {
+			return nil, err
+		}
+	}
+
+	v, ok := link.(*netlink.Vlan)
+	if !ok || v.ParentIndex != br.Attrs().Index || v.VlanId != vid {
+		return nil, fmt.Errorf("link %s already exists but is not vlan %d on bridge %s", name, vid, brName)
+	}
+	if link.Attrs().MTU != mtu {
+		if err := netlink.LinkSetMTU(link, mtu); err != nil {
+			return nil, fmt.Errorf("failed to set MTU of %s to %d: %v", name, mtu, err)
+		}
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+// attachUplink 把宿主机网卡 name 接入网桥 br，并以 tagged 方式加入 VLAN vid，作为通往物理网络的 trunk 端口
+//
+// 网卡上原有的地址不会被迁移，应当使用专门用于容器流量的网卡
+func attachUplink(br netlink.Link, name string, vid int) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to find uplink %s: %v", name, err)
+	}
+	if link.Attrs().MasterIndex != br.Attrs().Index {
+		if err := netlink.LinkSetMaster(link, br); err != nil {
+			return fmt.Errorf("failed to attach uplink %s to bridge %s: %v", name, br.Attrs().Name, err)
+		}
+	}
+	if err := netlink.BridgeVlanAdd(link, uint16(vid), false, false, false, true); err != nil {
+		return fmt.Errorf("failed to add vlan %d to uplink %s: %v", vid, name, err)
+	}
+	return netlink.LinkSetUp(link)
+}
+
+// setPortVlan 把网桥端口 port 的 PVID 设为 vid 并以 untagged 方式发出，同时让端口退出默认 VLAN，
+// 端口只能与同一个 VLAN 中的端口通信
+func setPortVlan(port netlink.Link, vid int) error {
+	name := port.Attrs().Name
+	if err := netlink.BridgeVlanAdd(port, uint16(vid), true, true, false, true); err != nil {
+		return fmt.Errorf("failed to add vlan %d to %s: %v", vid, name, err)
+	}
+	if vid == defaultPVID {
+		return nil
+	}
+	if err := netlink.BridgeVlanDel(port, defaultPVID, false, false, false, true); err != nil && err != syscall.ENOENT {
+		return fmt.Errorf("failed to remove default vlan from %s: %v", name, err)
+	}
+	return nil
+}
+
+// checkPortVlan 检查 ifindex 为 index 的网桥端口是否以 vid 作为 untagged 的 PVID
+func checkPortVlan(index, vid int, name string) error {
+	vlans, err := netlink.BridgeVlanList()
+	if err != nil {
+		return err
+	}
+	for _, v := range vlans[int32(index)] {
+		if int(v.Vid) == vid && v.PortVID() && v.EngressUntag() {
+			return nil
+		}
+	}
+	return fmt.Errorf("host veth %s is not an untagged member of vlan %d", name, vid)
+}
@@ -2,19 +2,110 @@ package config
 
 import (
 	"encoding/json"
+	"fmt"
+	"net"
 	"os"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/containernetworking/cni/pkg/types"
+
+	"github.com/kerolt/simple-cni/pkg/store"
 )
 
 const (
 	DefaultSubnetFile = "/run/simple-cni/subnets.json"
 	DefaultBridgeName = "simple-cni0"
+	DefaultVethPrefix = "veth"
+)
+
+// maxVethPrefixLen 是宿主机端 veth 名称前缀的最大长度，网卡名称最长 15 个字符，至少要给哈希留 8 个字符
+const maxVethPrefixLen = 7
+
+// maxVlanID 是 802.1Q 中可以使用的最大 VLAN ID
+const maxVlanID = 4094
+
+// vethPrefixRe 限制前缀中可以使用的字符
+var vethPrefixRe = regexp.MustCompile(`^[a-zA-Z0-9_.\-]+$`)
+
+// 容器接口接入宿主机网络的方式
+const (
+	ModeBridge  = "bridge"  // veth pair，宿主机端接到网桥上（默认）
+	ModeMacvlan = "macvlan" // 宿主机网卡的 macvlan 子接口（bridge 模式）
+	ModeIPVlan  = "ipvlan"  // 宿主机网卡的 ipvlan 子接口
+	ModeL3      = "l3"      // veth pair，宿主机端不接入网桥，通过 /32 主机路由与 proxy-ARP 三层转发
+)
+
+// ipvlan 子接口的工作模式
+const (
+	IPVlanModeL2 = "l2"
+	IPVlanModeL3 = "l3"
 )
 
 type SubnetConf struct {
-	Subnet string `json:"subnet"` // 如果 subnet = "10.244.0.0/24"，那么插件可以从 10.244.0.1 ~ 10.244.0.254 中选一个未被使用的 IP 分配给新容器。
-	Bridge string `json:"bridge"` // 桥接接口名称
+	Subnet string `json:"subnet"`         // 如果 subnet = "10.244.0.0/24"，那么插件可以从 10.244.0.1 ~ 10.244.0.254 中选一个未被使用的 IP 分配给新容器。
+	Bridge string `json:"bridge"`         // 桥接接口名称
+	Node   string `json:"node,omitempty"` // 当前节点名称，由守护进程写入
+	// Gateway 网桥上配置的网关地址，为空时使用子网的第一个可用地址
+	Gateway string `json:"gateway,omitempty"`
+	// PreviousGateway 子网或网关变化之前的网关地址（CIDR 格式），由守护进程写入。
+	// 开启 bridgeTeardown 时，网桥上还带着这个地址且没有任何端口时会被删除
+	PreviousGateway string `json:"previousGateway,omitempty"`
+	RangeConf
+}
+
+// PreviousGatewayNet 解析 PreviousGateway，没有记录时返回 nil
+func (c *SubnetConf) PreviousGatewayNet() (*net.IPNet, error) {
+	if c.PreviousGateway == "" {
+		return nil, nil
+	}
+	ip, ipnet, err := net.ParseCIDR(c.PreviousGateway)
+	if err != nil {
+		return nil, fmt.Errorf("invalid previousGateway %q: %v", c.PreviousGateway, err)
+	}
+	ipnet.IP = ip
+	return ipnet, nil
+}
+
+// merge 将网络配置中与子网相关的字段（subnet、bridge、gateway、地址范围）合并到 c 中
+//
+// 网络配置指定了与 subnets.json 不同的子网时（同一节点上的第二个网络），subnets.json 中的网关与地址范围不再适用
+func (c *SubnetConf) merge(other *SubnetConf) {
+	if other.Subnet != "" && other.Subnet != c.Subnet {
+		*c = SubnetConf{Subnet: other.Subnet, Bridge: c.Bridge, Node: c.Node}
+	}
+	if other.Bridge != "" {
+		// previousGateway 记录的是 subnets.json 中网桥的旧地址，换了网桥就不再适用
+		if other.Bridge != c.Bridge {
+			c.PreviousGateway = ""
+		}
+		c.Bridge = other.Bridge
+	}
+	if other.Gateway != "" {
+		c.Gateway = other.Gateway
+	}
+	c.RangeConf.merge(&other.RangeConf)
+}
+
+// RangeConf 限制可以自动分配的地址范围，既可以写在 subnets.json 中，也可以写在网络配置中
+//
+// 网络配置中的 rangeStart/rangeEnd 优先于 subnets.json，exclude 则取两者的并集
+type RangeConf struct {
+	RangeStart string   `json:"rangeStart,omitempty"` // 可分配范围的第一个地址，默认为子网的第一个可用地址
+	RangeEnd   string   `json:"rangeEnd,omitempty"`   // 可分配范围的最后一个地址，默认为广播地址的前一个地址
+	Exclude    []string `json:"exclude,omitempty"`    // 不参与分配的地址，可以是单个 IP 或 CIDR
+}
+
+// merge 用 other 中设置了的字段覆盖 r
+func (r *RangeConf) merge(other *RangeConf) {
+	if other.RangeStart != "" {
+		r.RangeStart = other.RangeStart
+	}
+	if other.RangeEnd != "" {
+		r.RangeEnd = other.RangeEnd
+	}
+	r.Exclude = append(r.Exclude, other.Exclude...)
 }
 
 type PluginConf struct {
@@ -24,20 +115,371 @@ type PluginConf struct {
 		Config map[string]any `json:"config"`
 	} `json:"runtime,omitempty"`
 
+	// RuntimeConfig 由容器运行时根据 capabilities（ips、mac）注入
+	RuntimeConfig *struct {
+		IPs []string `json:"ips,omitempty"`
+		Mac string   `json:"mac,omitempty"`
+	} `json:"runtimeConfig,omitempty"`
+
 	Args *struct {
-		Args map[string]any `json:"cni"`
+		Args *struct {
+			IPs []string `json:"ips,omitempty"`
+			Mac string   `json:"mac,omitempty"`
+		} `json:"cni,omitempty"`
 	} `json:"args"`
 
 	DataDir string `json:"dataDir"`
+	// Store 分配记录的存储后端：file（默认，JSON 文件）、bolt（嵌入式 KV 数据库）、crd（IPAllocation 自定义资源）、memory（仅用于测试）
+	Store string `json:"store,omitempty"`
+	// Kubeconfig crd 后端访问 API Server 使用的 kubeconfig 路径
+	Kubeconfig string `json:"kubeconfig,omitempty"`
+
+	StickyIP *StickyIPConf `json:"stickyIP,omitempty"`
+
+	// ReleaseCooldown 释放后的 IP 在这段时间内不会被再次分配（除非子网已经没有其他可用 IP），
+	// 避免陈旧的 conntrack、ARP 缓存与 DNS 记录指向新的 Pod
+	ReleaseCooldown Duration `json:"releaseCooldown"`
+
+	// HairpinMode 在宿主机端的网桥端口上开启 hairpin，Pod 可以通过 Service 的 ClusterIP 访问到自己
+	HairpinMode bool `json:"hairpinMode,omitempty"`
+	// PromiscMode 开启网桥的混杂模式
+	PromiscMode bool `json:"promiscMode,omitempty"`
+
+	// Mode 容器接口的接入方式：bridge（默认）、macvlan、ipvlan、l3
+	Mode string `json:"mode,omitempty"`
+	// Master macvlan/ipvlan 子接口的父设备，默认使用默认路由所在的网卡
+	Master string `json:"master,omitempty"`
+	// IPVlanMode ipvlan 子接口的工作模式：l2（默认）、l3
+	IPVlanMode string `json:"ipvlanMode,omitempty"`
+
+	// Sysctl 在容器网络命名空间中设置的 sysctl，键中的 {ifName} 会被替换为容器接口名称，
+	// 只允许 allowedSysctls 中与网络命名空间相关的参数
+	Sysctl map[string]string `json:"sysctl,omitempty"`
+	// Tuning 容器内接口的网卡参数
+	Tuning *TuningConf `json:"tuning,omitempty"`
+
+	// Routes 在容器内添加的路由，dst 为 0.0.0.0/0 的路由会替换指向网关的默认路由
+	Routes []RouteConf `json:"routes,omitempty"`
+
+	// BridgeTeardown 子网变化后在网桥上保留旧的网关地址，网桥没有任何端口且还带着 subnets.json 中的 previousGateway 时，
+	// 由 DEL 或 simple-cnid 的节点 GC 删除网桥，下一次 ADD 会按新的子网重新创建
+	BridgeTeardown bool `json:"bridgeTeardown,omitempty"`
+
+	// VethPrefix 宿主机端 veth 名称的前缀，名称的其余部分是容器 ID 与接口名称的哈希，默认为 DefaultVethPrefix
+	VethPrefix string `json:"vethPrefix,omitempty"`
+
+	// VlanFiltering 开启网桥的 VLAN 过滤，设置了 Vlan 时自动开启
+	VlanFiltering bool `json:"vlanFiltering,omitempty"`
+	// Vlan 网络的 VLAN ID（1-4094），宿主机端 veth 以它作为 PVID 并以 untagged 方式接入网桥，
+	// 多个网络共用一个网桥时彼此在二层隔离，网关地址配置在网桥的 VLAN 子接口上
+	Vlan int `json:"vlan,omitempty"`
+	// Uplink 以 trunk 方式接入网桥的宿主机网卡，Vlan 的报文带着 VLAN 标签从这里发往物理网络
+	Uplink string `json:"uplink,omitempty"`
+}
+
+// RouteConf 容器内的一条路由
+type RouteConf struct {
+	Dst    string `json:"dst"`              // 目的网段，如 10.96.0.0/12
+	GW     string `json:"gw,omitempty"`     // 下一跳，为空时路由直接指向容器接口
+	Metric int    `json:"metric,omitempty"` // 路由的优先级，越小越优先
+	MTU    int    `json:"mtu,omitempty"`    // 这条路由使用的 MTU，0 表示使用接口的 MTU
+}
+
+// ParseRoutes 解析网络配置中的路由
+func (c *PluginConf) ParseRoutes() ([]*types.Route, error) {
+	routes := make([]*types.Route, 0, len(c.Routes))
+	for _, r := range c.Routes {
+		_, dst, err := net.ParseCIDR(r.Dst)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route dst %q: %v", r.Dst, err)
+		}
+
+		route := &types.Route{Dst: *dst, Priority: r.Metric, MTU: r.MTU}
+		if r.GW != "" {
+			if route.GW = net.ParseIP(r.GW); route.GW == nil {
+				return nil, fmt.Errorf("invalid route gw %q", r.GW)
+			}
+			if (route.GW.To4() == nil) != (dst.IP.To4() == nil) {
+				return nil, fmt.Errorf("route gw %s and dst %s are of different address families", r.GW, r.Dst)
+			}
+		}
+		if r.Metric < 0 || r.MTU < 0 {
+			return nil, fmt.Errorf("invalid metric or mtu in route to %s", r.Dst)
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// TuningConf 容器内接口的网卡参数
+type TuningConf struct {
+	DisableIPv6RA bool            `json:"disableIPv6RA,omitempty"` // 不接受 IPv6 路由通告
+	TxQueueLen    int             `json:"txQueueLen,omitempty"`    // 发送队列长度
+	Offloads      map[string]bool `json:"offloads,omitempty"`      // ethtool 特性的开关，如 {"tx-checksum-ip-generic": false}
+	Promisc       bool            `json:"promisc,omitempty"`       // 开启接口的混杂模式
+}
+
+// allowedSysctls 是可以在容器网络命名空间中设置的 sysctl，以 * 结尾的表示前缀
+//
+// 只包含按网络命名空间隔离的参数，避免通过网络配置修改整个节点的内核参数
+var allowedSysctls = []string{
+	"net.ipv4.conf.*",
+	"net.ipv6.conf.*",
+	"net.ipv4.neigh.*",
+	"net.ipv6.neigh.*",
+	"net.ipv4.tcp_*",
+	"net.ipv4.ip_local_port_range",
+	"net.ipv4.ip_local_reserved_ports",
+	"net.ipv4.ip_unprivileged_port_start",
+	"net.ipv4.ping_group_range",
+	"net.core.somaxconn",
+}
+
+// sysctlKeyRe 限制 sysctl 键中可以出现的字符，不允许 / 与 ..，键只能指向 /proc/sys/net 下的文件
+var sysctlKeyRe = regexp.MustCompile(`^[a-zA-Z0-9_\-]+(\.([a-zA-Z0-9_\-]+|\{ifName\}))+$`)
+
+// validateSysctl 校验 sysctl 的键是否在白名单中
+func validateSysctl(key string) error {
+	if !sysctlKeyRe.MatchString(key) {
+		return fmt.Errorf("invalid sysctl %q", key)
+	}
+	for _, allowed := range allowedSysctls {
+		if prefix, ok := strings.CutSuffix(allowed, "*"); ok {
+			if strings.HasPrefix(key, prefix) {
+				return nil
+			}
+		} else if key == allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("sysctl %q is not allowed, allowed sysctls: %s", key, strings.Join(allowedSysctls, ", "))
+}
+
+// validate 校验接入方式、VLAN、veth 名称前缀、sysctl 与网卡参数、路由与 DNS，并填充默认值
+func (c *PluginConf) validate() error {
+	if _, err := c.ParseRoutes(); err != nil {
+		return err
+	}
+	for _, ns := range c.DNS.Nameservers {
+		if net.ParseIP(ns) == nil {
+			return fmt.Errorf("invalid DNS nameserver %q", ns)
+		}
+	}
+
+	for key := range c.Sysctl {
+		if err := validateSysctl(key); err != nil {
+			return err
+		}
+	}
+	if c.Tuning != nil && c.Tuning.TxQueueLen < 0 {
+		return fmt.Errorf("invalid txQueueLen %d", c.Tuning.TxQueueLen)
+	}
+
+	if c.VethPrefix == "" {
+		c.VethPrefix = DefaultVethPrefix
+	}
+	if len(c.VethPrefix) > maxVethPrefixLen || !vethPrefixRe.MatchString(c.VethPrefix) {
+		return fmt.Errorf("invalid vethPrefix %q: must be at most %d characters of %s", c.VethPrefix, maxVethPrefixLen, vethPrefixRe)
+	}
+
+	switch c.Mode {
+	case "":
+		c.Mode = ModeBridge
+	case ModeBridge, ModeMacvlan, ModeIPVlan, ModeL3:
+	default:
+		return fmt.Errorf("unknown mode %q, must be one of %s, %s, %s, %s", c.Mode, ModeBridge, ModeMacvlan, ModeIPVlan, ModeL3)
+	}
+
+	if err := c.validateVlan(); err != nil {
+		return err
+	}
+
+	if c.Mode != ModeIPVlan {
+		if c.IPVlanMode != "" {
+			return fmt.Errorf("ipvlanMode is only supported in %s mode", ModeIPVlan)
+		}
+		return nil
+	}
+	switch c.IPVlanMode {
+	case "":
+		c.IPVlanMode = IPVlanModeL2
+	case IPVlanModeL2, IPVlanModeL3:
+	default:
+		return fmt.Errorf("unknown ipvlanMode %q, must be %s or %s", c.IPVlanMode, IPVlanModeL2, IPVlanModeL3)
+	}
+	return nil
+}
+
+// UsesVeth 返回容器接口是否是 veth pair（bridge 与 l3 模式），宿主机端 veth 的名称见 VethPrefix
+func (c *PluginConf) UsesVeth() bool {
+	return c.Mode == ModeBridge || c.Mode == ModeL3
+}
+
+// validateVlan 校验网桥的 VLAN 配置，设置了 Vlan 时开启 VlanFiltering
+func (c *PluginConf) validateVlan() error {
+	if c.Mode != ModeBridge && (c.VlanFiltering || c.Vlan != 0 || c.Uplink != "") {
+		return fmt.Errorf("vlanFiltering, vlan and uplink are only supported in %s mode", ModeBridge)
+	}
+	if c.Vlan < 0 || c.Vlan > maxVlanID {
+		return fmt.Errorf("invalid vlan %d, must be between 1 and %d", c.Vlan, maxVlanID)
+	}
+	if c.Uplink != "" && c.Vlan == 0 {
+		return fmt.Errorf("uplink requires vlan")
+	}
+	if c.Vlan != 0 {
+		c.VlanFiltering = true
+	}
+	return nil
+}
+
+// StickyIPConf 有状态 Pod（如 StatefulSet）的固定 IP 配置
+//
+// 开启后，DEL 时会按 K8S_POD_NAMESPACE/K8S_POD_NAME 为 Pod 保留原来的 IP，
+// 同名 Pod 在保留期内重新调度到本节点时会拿回同一个 IP
+type StickyIPConf struct {
+	Enabled     bool     `json:"enabled"`
+	GracePeriod Duration `json:"gracePeriod"` // IP 的保留时长，默认 DefaultStickyGracePeriod
+}
+
+const DefaultStickyGracePeriod = 5 * time.Minute
+
+// Duration 支持在 JSON 中使用 "30s"、"5m" 这样的时长写法
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("invalid duration %s: %v", string(b), err)
+	}
+
+	dur, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q: %v", s, err)
+	}
+	d.Duration = dur
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// EnvArgs 对应 CNI_ARGS 环境变量，格式如 "IP=10.244.0.10;MAC=aa:bb:cc:dd:ee:ff"
+type EnvArgs struct {
+	types.CommonArgs
+	IP  types.UnmarshallableString
+	MAC types.UnmarshallableString
+
+	// kubelet 传入的 Pod 信息
+	K8S_POD_NAMESPACE          types.UnmarshallableString
+	K8S_POD_NAME               types.UnmarshallableString
+	K8S_POD_INFRA_CONTAINER_ID types.UnmarshallableString
+	K8S_POD_UID                types.UnmarshallableString
+}
+
+// PodRef 返回 CNI_ARGS 中的 Pod 信息，没有 Pod 信息时返回 nil
+func (a *EnvArgs) PodRef() *store.PodRef {
+	if a.PodKey() == "" {
+		return nil
+	}
+	return &store.PodRef{
+		Namespace: string(a.K8S_POD_NAMESPACE),
+		Name:      string(a.K8S_POD_NAME),
+		UID:       string(a.K8S_POD_UID),
+	}
+}
+
+// PodKey 返回 "<namespace>/<name>" 形式的 Pod 标识，CNI_ARGS 中没有 Pod 信息时返回空字符串
+func (a *EnvArgs) PodKey() string {
+	if a.K8S_POD_NAMESPACE == "" || a.K8S_POD_NAME == "" {
+		return ""
+	}
+	return string(a.K8S_POD_NAMESPACE) + "/" + string(a.K8S_POD_NAME)
 }
 
 type CNIConf struct {
 	SubnetConf
 	PluginConf
+	EnvArgs EnvArgs
+}
+
+// StickyGracePeriod 返回固定 IP 的保留时长，未开启时返回 0
+func (c *CNIConf) StickyGracePeriod() time.Duration {
+	if c.StickyIP == nil || !c.StickyIP.Enabled {
+		return 0
+	}
+	if c.StickyIP.GracePeriod.Duration <= 0 {
+		return DefaultStickyGracePeriod
+	}
+	return c.StickyIP.GracePeriod.Duration
 }
 
-// loadSubnetConfig 从默认路径加载子网配置文件
-func loadSubnetConfig() (*SubnetConf, error) {
+// RequestedIP 返回容器请求的静态 IP，没有请求时返回 nil
+//
+// 优先级：runtimeConfig.ips > args.cni.ips > CNI_ARGS 中的 IP
+func (c *CNIConf) RequestedIP() (net.IP, error) {
+	var ips []string
+	if c.RuntimeConfig != nil && len(c.RuntimeConfig.IPs) > 0 {
+		ips = c.RuntimeConfig.IPs
+	} else if c.Args != nil && c.Args.Args != nil && len(c.Args.Args.IPs) > 0 {
+		ips = c.Args.Args.IPs
+	} else if c.EnvArgs.IP != "" {
+		ips = []string{string(c.EnvArgs.IP)}
+	}
+
+	if len(ips) == 0 {
+		return nil, nil
+	}
+	if len(ips) > 1 {
+		return nil, fmt.Errorf("only one static IP is supported, got %v", ips)
+	}
+
+	return parseIP(ips[0])
+}
+
+// RequestedMAC 返回容器请求的 MAC 地址，没有请求时返回空字符串
+//
+// 优先级：runtimeConfig.mac > args.cni.mac > CNI_ARGS 中的 MAC
+func (c *CNIConf) RequestedMAC() (string, error) {
+	var mac string
+	if c.RuntimeConfig != nil && c.RuntimeConfig.Mac != "" {
+		mac = c.RuntimeConfig.Mac
+	} else if c.Args != nil && c.Args.Args != nil && c.Args.Args.Mac != "" {
+		mac = c.Args.Args.Mac
+	} else {
+		mac = string(c.EnvArgs.MAC)
+	}
+
+	if mac == "" {
+		return "", nil
+	}
+	if _, err := net.ParseMAC(mac); err != nil {
+		return "", fmt.Errorf("invalid MAC address %q: %v", mac, err)
+	}
+	return mac, nil
+}
+
+// parseIP 同时支持 "10.244.0.10" 与 "10.244.0.10/24" 两种写法
+func parseIP(s string) (net.IP, error) {
+	if strings.Contains(s, "/") {
+		ip, _, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP address %q: %v", s, err)
+		}
+		return ip, nil
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address %q", s)
+	}
+	return ip, nil
+}
+
+// LoadSubnetConfig 从默认路径加载子网配置文件
+func LoadSubnetConfig() (*SubnetConf, error) {
 	data, err := os.ReadFile(DefaultSubnetFile)
 	if err != nil {
 		return nil, err
@@ -51,13 +493,25 @@ func loadSubnetConfig() (*SubnetConf, error) {
 	return config, nil
 }
 
+// StoreSubnetConfig 保存子网配置文件
+//
+// 先写入临时文件再 rename，插件在守护进程更新子网配置的同时读取时，只会读到完整的旧配置或新配置
 func StoreSubnetConfig(config *SubnetConf) error {
 	data, err := json.Marshal(config)
 	if err != nil {
 		return err
 	}
 
-	return os.WriteFile(DefaultSubnetFile, data, 0644)
+	tmpFile := DefaultSubnetFile + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	if err := os.Rename(tmpFile, DefaultSubnetFile); err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	return nil
 }
 
 func parsePluginConfig(data []byte) (*PluginConf, error) {
@@ -65,22 +519,46 @@ func parsePluginConfig(data []byte) (*PluginConf, error) {
 	if err := json.Unmarshal(data, config); err != nil {
 		return nil, err
 	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
 	return config, nil
 }
 
-func LoadCNIConfig(stdin []byte) (*CNIConf, error) {
-	pluginConf, err := parsePluginConfig(stdin)
+// ParseNetworkConfig 解析网络配置，SubnetConf 中只有网络配置本身写了的字段，不读取 subnets.json
+//
+// 守护进程在生成 subnets.json 之前用它读取网络配置中的网关、网桥与 VLAN，与插件使用同一份配置
+func ParseNetworkConfig(raw []byte) (*CNIConf, error) {
+	pluginConf, err := parsePluginConfig(raw)
 	if err != nil {
 		return nil, err
 	}
 
-	subnetConf, err := loadSubnetConfig()
+	subnetConf := &SubnetConf{}
+	if err := json.Unmarshal(raw, subnetConf); err != nil {
+		return nil, err
+	}
+	return &CNIConf{SubnetConf: *subnetConf, PluginConf: *pluginConf}, nil
+}
+
+// LoadCNIConfig 加载插件配置、子网配置以及 CNI_ARGS
+func LoadCNIConfig(stdin []byte, args string) (*CNIConf, error) {
+	conf, err := ParseNetworkConfig(stdin)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := types.LoadArgs(args, &conf.EnvArgs); err != nil {
+		return nil, err
+	}
+
+	subnetConf, err := LoadSubnetConfig()
 	if err != nil {
 		return nil, err
 	}
 
-	return &CNIConf{
-		SubnetConf: *subnetConf,
-		PluginConf: *pluginConf,
-	}, nil
+	// 网络配置中的网关与地址范围覆盖 subnets.json
+	subnetConf.merge(&conf.SubnetConf)
+	conf.SubnetConf = *subnetConf
+	return conf, nil
 }
@@ -0,0 +1,210 @@
+package ipam
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/kerolt/simple-cni/pkg/store"
+
+	cip "github.com/containernetworking/plugins/pkg/ip"
+)
+
+// maxCountRange 是 Usage 逐个统计的地址数量上限，避免在很大的 IPv6 子网上长时间遍历
+const maxCountRange = 1 << 20
+
+// Entry 是一条带 IP 地址的分配记录
+type Entry struct {
+	IP string `json:"ip"`
+	store.Allocation
+}
+
+// Usage 是可分配范围内 IP 的使用情况
+type Usage struct {
+	Subnet     string `json:"subnet"`
+	RangeStart string `json:"rangeStart"`
+	RangeEnd   string `json:"rangeEnd"`
+	Total      int    `json:"total"`      // 可分配的地址数，不含网关与被排除的地址
+	Used       int    `json:"used"`       // 已分配的地址数
+	Reserved   int    `json:"reserved"`   // 固定 IP 模式下仍为 Pod 保留的地址数
+	Free       int    `json:"free"`       // 可以分配给新容器的地址数
+	OutOfRange int    `json:"outOfRange"` // 位于可分配范围之外的分配（如静态 IP）
+}
+
+// Allocations 返回按 IP 排序的所有分配记录
+func (ipam *IPAM) Allocations() ([]Entry, error) {
+	if err := ipam.store.Lock(); err != nil {
+		return nil, err
+	}
+	defer ipam.store.Unlock()
+
+	if err := ipam.store.LoadData(); err != nil {
+		return nil, err
+	}
+
+	entries := []Entry{}
+	ipam.store.Iterate(func(ip net.IP, alloc store.Allocation) bool {
+		entries = append(entries, Entry{IP: ip.String(), Allocation: alloc})
+		return true
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		return cip.Cmp(net.ParseIP(entries[i].IP), net.ParseIP(entries[j].IP)) < 0
+	})
+	return entries, nil
+}
+
+// Usage 统计可分配范围内 IP 的使用情况
+func (ipam *IPAM) Usage() (*Usage, error) {
+	if err := ipam.store.Lock(); err != nil {
+		return nil, err
+	}
+	defer ipam.store.Unlock()
+
+	if err := ipam.store.LoadData(); err != nil {
+		return nil, err
+	}
+
+	u := &Usage{
+		Subnet:     ipam.subnet.String(),
+		RangeStart: ipam.ipRange.start.String(),
+		RangeEnd:   ipam.ipRange.end.String(),
+	}
+
+	n := 0
+	for ip := ipam.ipRange.start; ; ip = cip.NextIP(ip) {
+		if n++; n > maxCountRange {
+			return nil, fmt.Errorf("range %s-%s is too large to count", ipam.ipRange.start, ipam.ipRange.end)
+		}
+
+		if ipam.allocatable(ip) {
+			u.Total++
+			if ipam.store.Contain(ip) {
+				u.Used++
+			} else if _, _, ok := ipam.store.ReservedBy(ip); ok {
+				u.Reserved++
+			} else {
+				u.Free++
+			}
+		}
+
+		if ip.Equal(ipam.ipRange.end) {
+			break
+		}
+	}
+
+	ipam.store.Iterate(func(ip net.IP, _ store.Allocation) bool {
+		if !ipam.ipRange.contains(normalize(ip)) {
+			u.OutOfRange++
+		}
+		return true
+	})
+	return u, nil
+}
+
+// Validate 检查 store 中的分配记录与当前网络配置是否一致，返回发现的问题，没有问题时返回空
+func (ipam *IPAM) Validate() ([]string, error) {
+	if err := ipam.store.Lock(); err != nil {
+		return nil, err
+	}
+	defer ipam.store.Unlock()
+
+	if err := ipam.store.LoadData(); err != nil {
+		return nil, err
+	}
+
+	var problems []string
+	owners := make(map[string]string)
+	ipam.store.Iterate(func(ip net.IP, alloc store.Allocation) bool {
+		ip = normalize(ip)
+		switch {
+		case !ipam.subnet.Contains(ip):
+			problems = append(problems, fmt.Sprintf("%s is not in subnet %s", ip, ipam.subnet))
+		case ip.Equal(ipam.gateway):
+			problems = append(problems, fmt.Sprintf("%s is the gateway address", ip))
+		case ipam.ipRange.isReserved(ip):
+			problems = append(problems, fmt.Sprintf("%s is the network or broadcast address", ip))
+		case ipam.ipRange.isExcluded(ip):
+			problems = append(problems, fmt.Sprintf("%s is excluded from allocation", ip))
+		}
+
+		if alloc.ContainerID == "" {
+			problems = append(problems, fmt.Sprintf("%s has no container ID", ip))
+		} else if alloc.ContainerID == store.RecoveredContainerID {
+			problems = append(problems, fmt.Sprintf("%s was recovered from live interfaces and has no owner", ip))
+		} else {
+			key := alloc.ContainerID + "/" + alloc.IfName
+			if prev, ok := owners[key]; ok {
+				problems = append(problems, fmt.Sprintf("interface %s of container %s has both %s and %s", alloc.IfName, alloc.ContainerID, prev, ip))
+			}
+			owners[key] = ip.String()
+		}
+		return true
+	})
+
+	sort.Strings(problems)
+	return problems, nil
+}
+
+// ReleaseMatching 释放所有满足 match 的分配记录，返回被释放的 IP
+//
+// 与 ReleaseIP 不同，这里不会为 Pod 保留 IP，用于运维工具与垃圾回收清理不再使用的分配
+func (ipam *IPAM) ReleaseMatching(match func(ip net.IP, alloc store.Allocation) bool) ([]net.IP, error) {
+	if err := ipam.store.Lock(); err != nil {
+		return nil, err
+	}
+	defer ipam.store.Unlock()
+
+	if err := ipam.store.LoadData(); err != nil {
+		return nil, err
+	}
+
+	// 按 IP 删除，从网络接口恢复出来的记录共用同一个容器 ID，不能按容器与接口区分
+	var matched []net.IP
+	ipam.store.Iterate(func(ip net.IP, alloc store.Allocation) bool {
+		if match(ip, alloc) {
+			matched = append(matched, ip)
+		}
+		return true
+	})
+
+	var released []net.IP
+	for _, ip := range matched {
+		ok, err := ipam.store.DelIP(ip)
+		if err != nil {
+			return released, err
+		}
+		if ok {
+			released = append(released, ip)
+		}
+	}
+	return released, nil
+}
+
+// ReserveIP 在 d 时间内为 Pod 的 ifName 接口保留 ip，期间该 IP 不会分配给其他 Pod
+func (ipam *IPAM) ReserveIP(ip net.IP, pod, ifName string, d time.Duration) error {
+	if _, _, ok := store.SplitPodKey(pod); !ok {
+		return fmt.Errorf("invalid pod %q, expected <namespace>/<name>", pod)
+	}
+	ip = normalize(ip)
+	if !ipam.subnet.Contains(ip) {
+		return fmt.Errorf("IP %s is not in subnet %s", ip, ipam.subnet)
+	}
+	if !ipam.allocatable(ip) {
+		return fmt.Errorf("IP %s is reserved or excluded from allocation", ip)
+	}
+
+	if err := ipam.store.Lock(); err != nil {
+		return err
+	}
+	defer ipam.store.Unlock()
+
+	if err := ipam.store.LoadData(); err != nil {
+		return err
+	}
+
+	if ipam.inUse(ip, pod, ifName) {
+		return fmt.Errorf("IP %s: %w", ip, ErrIPInUse)
+	}
+	return ipam.store.Reserve(ip, pod, ifName, time.Now().Add(d))
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"time"
 
 	"github.com/kerolt/simple-cni/pkg/config"
 	"github.com/kerolt/simple-cni/pkg/store"
@@ -13,26 +14,40 @@ import (
 
 var (
 	ErrIPOverflow = errors.New("IP address overflow")
+	ErrIPInUse    = errors.New("IP address already in use")
 )
 
+// conflictRetries 是 store 返回 ErrConflict（crd 后端的记录被其他写入者修改）时重新加载并重试的次数
+const conflictRetries = 3
+
 type IPAM struct {
-	subnet  *net.IPNet   // IPAM 管理的网段
-	gateway net.IP       // 默认网关 IP，一般分配给容器网络的第一个 IP
-	store   *store.Store // 记录已经分配的 IP 信息
+	subnet      *net.IPNet    // IPAM 管理的网段
+	gateway     net.IP        // 默认网关 IP，一般分配给容器网络的第一个 IP
+	ipRange     *ipRange      // 可以自动分配的地址范围
+	store       store.Backend // 记录已经分配的 IP 信息
+	stickyGrace time.Duration // 固定 IP 模式下 DEL 后为 Pod 保留 IP 的时长，为 0 表示不开启
+	cooldown    time.Duration // 释放后的 IP 的冷却时长，冷却期内尽量不再分配
 }
 
-func NewIPAM(conf *config.CNIConf, store *store.Store) (*IPAM, error) {
+func NewIPAM(conf *config.CNIConf, store store.Backend) (*IPAM, error) {
 	_, ipnet, err := net.ParseCIDR(conf.Subnet)
 	if err != nil {
 		return nil, err
 	}
 
 	ipam := &IPAM{
-		subnet: ipnet,
-		store:  store,
+		subnet:      ipnet,
+		store:       store,
+		stickyGrace: conf.StickyGracePeriod(),
+		cooldown:    conf.ReleaseCooldown.Duration,
+	}
+
+	ipam.gateway, err = ParseGateway(ipnet, conf.Gateway)
+	if err != nil {
+		return nil, err
 	}
 
-	ipam.gateway, err = ipam.NextIP(ipnet.IP)
+	ipam.ipRange, err = newIPRange(ipnet, &conf.RangeConf)
 	if err != nil {
 		return nil, err
 	}
@@ -40,6 +55,47 @@ func NewIPAM(conf *config.CNIConf, store *store.Store) (*IPAM, error) {
 	return ipam, nil
 }
 
+// Close 释放 store 占用的资源
+func (ipam *IPAM) Close() error {
+	return ipam.store.Close()
+}
+
+// WithLock 持有 store 的锁执行 fn，ADD 创建网桥与 veth、DEL 删除网桥时使用，避免两者交错
+func (ipam *IPAM) WithLock(fn func() error) error {
+	if err := ipam.store.Lock(); err != nil {
+		return err
+	}
+	defer ipam.store.Unlock()
+	return fn()
+}
+
+// ParseGateway 解析并校验网关地址，gateway 为空时返回子网的第一个可用地址
+//
+// 守护进程创建网桥与插件分配 IP 都通过它计算网关，保证两边一致
+func ParseGateway(subnet *net.IPNet, gateway string) (net.IP, error) {
+	if gateway == "" {
+		gw := cip.NextIP(subnet.IP)
+		if !subnet.Contains(gw) {
+			return nil, ErrIPOverflow
+		}
+		return gw, nil
+	}
+
+	gw := net.ParseIP(gateway)
+	if gw == nil {
+		return nil, fmt.Errorf("invalid gateway %q", gateway)
+	}
+	if !subnet.Contains(gw) {
+		return nil, fmt.Errorf("gateway %s is not in subnet %s", gw, subnet)
+	}
+
+	r := &ipRange{subnet: subnet}
+	if r.isReserved(gw) {
+		return nil, fmt.Errorf("gateway %s is the network or broadcast address of %s", gw, subnet)
+	}
+	return normalize(gw), nil
+}
+
 // NextIP 计算给定 IP 的下一个 IP 地址，并确保它在子网范围内
 func (ipam *IPAM) NextIP(ip net.IP) (net.IP, error) {
 	next := cip.NextIP(ip)
@@ -49,6 +105,16 @@ func (ipam *IPAM) NextIP(ip net.IP) (net.IP, error) {
 	return next, nil
 }
 
+// Store 返回 IPAM 使用的 store
+func (ipam *IPAM) Store() store.Backend {
+	return ipam.store
+}
+
+// Subnet 返回 IPAM 管理的网段
+func (ipam *IPAM) Subnet() *net.IPNet {
+	return ipam.subnet
+}
+
 func (ipam *IPAM) Mask() net.IPMask {
 	return ipam.subnet.Mask
 }
@@ -70,50 +136,102 @@ func (ipam *IPAM) GenIPNet(ip net.IP) *net.IPNet {
 
 // AllocateIP 为指定容器分配一个尚未被使用的 IP 地址
 //
-//	ip 容器唯一标识符
-//	ifName 接口名称
-func (ipam *IPAM) AllocateIP(id, ifName string) (net.IP, error) {
-	ipam.store.Lock()
+//	alloc 分配记录，(ContainerID, IfName) 标识容器的接口，其中的 Pod 信息用于固定 IP 模式，可以为空
+//	reqIP 容器请求的静态 IP，为 nil 时自动分配
+func (ipam *IPAM) AllocateIP(alloc store.Allocation, reqIP net.IP) (net.IP, error) {
+	if err := ipam.store.Lock(); err != nil {
+		return nil, err
+	}
 	defer ipam.store.Unlock()
 
+	var ip net.IP
+	err := ipam.retryOnConflict(func() (err error) {
+		ip, err = ipam.allocateIP(alloc, reqIP)
+		return err
+	})
+	return ip, err
+}
+
+// retryOnConflict 执行 fn，fn 因 store.ErrConflict 失败时重新执行，最多重试 conflictRetries 次，调用方需持有 store 的锁
+//
+// fn 需要自己调用 LoadData，重试时内存中的数据会被 API Server 上的最新记录覆盖
+func (ipam *IPAM) retryOnConflict(fn func() error) error {
+	var err error
+	for i := 0; i <= conflictRetries; i++ {
+		if err = fn(); !errors.Is(err, store.ErrConflict) {
+			return err
+		}
+	}
+	return err
+}
+
+// allocateIP 重新加载分配记录并分配 IP，调用方需持有 store 的锁
+func (ipam *IPAM) allocateIP(alloc store.Allocation, reqIP net.IP) (net.IP, error) {
 	if err := ipam.store.LoadData(); err != nil {
 		return nil, err
 	}
 
-	// 检查该容器是否已经分配了 IP
-	ip, ok := ipam.store.GetIPById(id)
+	id, ifName, pod := alloc.ContainerID, alloc.IfName, alloc.Pod()
+
+	// 检查该容器的这个接口是否已经分配了 IP
+	ip, ok := ipam.store.GetIP(id, ifName)
 	if ok {
+		if reqIP != nil && !reqIP.Equal(ip) {
+			return nil, fmt.Errorf("interface %s of container %s already has IP %s, cannot assign requested IP %s", ifName, id, ip, reqIP)
+		}
 		return ip, nil
 	}
 
-	// 如果之前还没分配，则从网关ip开始
-	// 通常网关是 .1，比如 192.168.1.1，所以第一个可用 IP 可能是 .2
-	lastIP := ipam.store.Last()
-	if len(lastIP) == 0 {
-		lastIP = ipam.gateway
+	if reqIP != nil {
+		return ipam.allocateStaticIP(alloc, reqIP)
 	}
 
-	currIP := make(net.IP, len(lastIP))
-	copy(currIP, lastIP)
-	for {
-		nextIP, err := ipam.NextIP(currIP)
+	// 冷却期已过的释放记录不再需要
+	ipam.store.PurgeReleased(time.Now().Add(-ipam.cooldown))
 
-		// 如果 ip 溢出了并且上次不是从网关开始的，从头再来避免漏掉前面未分配的 ip
-		if err == ErrIPOverflow && !lastIP.Equal(ipam.gateway) {
-			currIP = ipam.gateway
-			continue
-		} else if err != nil {
-			return nil, err
+	// 固定 IP 模式下，同一个 Pod 优先拿回之前保留的 IP
+	if ipam.sticky(pod) {
+		if ip, ok := ipam.store.GetReservedIP(pod, ifName); ok && !ipam.store.Contain(ip) {
+			// 地址范围、排除列表或网关变化之后，保留的 IP 可能已经不允许分配，让这条保留立即过期并重新分配
+			if !ipam.ipRange.contains(ip) || !ipam.allocatable(ip) {
+				if err := ipam.store.Reserve(ip, pod, ifName, time.Now()); err != nil {
+					return nil, err
+				}
+			} else {
+				if err := ipam.store.Add(ip, alloc); err != nil {
+					return nil, err
+				}
+				return ip, nil
+			}
 		}
+	}
 
-		// 如果 nextIP 未分配过，那么就分配这个，并将其与 id、ifName 绑定
-		if !ipam.store.Contain(nextIP) {
-			err := ipam.store.Add(nextIP, id, ifName)
-			return nextIP, err
-		}
+	// 从上次分配的 IP 的下一个开始，在可分配范围内循环扫描一圈
+	// 如果之前还没分配过（或者上次分配的 IP 已经不在范围内），则从 rangeStart 开始
+	lastIP := ipam.store.Last()
+	if len(lastIP) == 0 || !ipam.ipRange.contains(lastIP) {
+		lastIP = ipam.ipRange.end
+	}
+
+	// 冷却期内的 IP 先跳过，记录其中释放最早的一个，子网没有其他可用 IP 时再使用
+	var fallback net.IP
+	var fallbackAt time.Time
 
-		// 如果分配过了，下一个
-		currIP = nextIP
+	currIP := lastIP
+	for {
+		currIP = ipam.ipRange.next(currIP)
+
+		// 如果 currIP 可以分配且未被使用，那么就分配这个，并将其与 id、ifName 绑定
+		if ipam.allocatable(currIP) && !ipam.inUse(currIP, pod, ifName) {
+			releasedAt, ok := ipam.store.ReleasedAt(currIP)
+			if !ok {
+				err := ipam.store.Add(currIP, alloc)
+				return currIP, err
+			}
+			if fallback == nil || releasedAt.Before(fallbackAt) {
+				fallback, fallbackAt = currIP, releasedAt
+			}
+		}
 
 		// 如果又回到了和 lastIP 一样，说明可用 IP 已经分配完了
 		if currIP.Equal(lastIP) {
@@ -121,33 +239,107 @@ func (ipam *IPAM) AllocateIP(id, ifName string) (net.IP, error) {
 		}
 	}
 
+	if fallback != nil {
+		err := ipam.store.Add(fallback, alloc)
+		return fallback, err
+	}
+
 	return nil, fmt.Errorf("no available IP")
 }
 
-// ReleaseIP 收回容器 id 的 IP
-func (ipam *IPAM) ReleaseIP(id string) error {
-	ipam.store.Lock()
+// sticky 判断是否需要为该 Pod 启用固定 IP
+func (ipam *IPAM) sticky(pod string) bool {
+	return ipam.stickyGrace > 0 && pod != ""
+}
+
+// allocatable 判断 IP 是否允许分配：不能是网络地址、广播地址、网关以及被排除的地址
+func (ipam *IPAM) allocatable(ip net.IP) bool {
+	return !ipam.ipRange.isReserved(ip) && !ip.Equal(ipam.gateway) && !ipam.ipRange.isExcluded(ip)
+}
+
+// inUse 判断 IP 是否已被分配，或者正在为其他 Pod（或同一 Pod 的其他接口）保留
+func (ipam *IPAM) inUse(ip net.IP, pod, ifName string) bool {
+	if ipam.store.Contain(ip) {
+		return true
+	}
+	owner, ownerIf, ok := ipam.store.ReservedBy(ip)
+	return ok && (pod == "" || owner != pod || (ownerIf != "" && ownerIf != ifName))
+}
+
+// allocateStaticIP 为容器保留指定的 IP，调用方需持有 store 的锁
+//
+// 静态 IP 不受 rangeStart/rangeEnd 的限制，只要位于子网内且没有被排除即可
+func (ipam *IPAM) allocateStaticIP(alloc store.Allocation, reqIP net.IP) (net.IP, error) {
+	if ip4 := reqIP.To4(); ip4 != nil {
+		reqIP = ip4
+	}
+
+	if !ipam.subnet.Contains(reqIP) {
+		return nil, fmt.Errorf("requested IP %s is not in subnet %s", reqIP, ipam.subnet)
+	}
+	if !ipam.allocatable(reqIP) {
+		return nil, fmt.Errorf("requested IP %s is reserved or excluded from allocation", reqIP)
+	}
+	if ipam.inUse(reqIP, alloc.Pod(), alloc.IfName) {
+		return nil, fmt.Errorf("requested IP %s: %w", reqIP, ErrIPInUse)
+	}
+
+	if err := ipam.store.Add(reqIP, alloc); err != nil {
+		return nil, err
+	}
+	return reqIP, nil
+}
+
+// ReleaseIP 收回容器 id 的 ifName 接口的 IP，固定 IP 模式下会继续为 pod 的该接口保留这个 IP 一段时间
+//
+// 返回被收回的 IP，容器接口没有分配记录时返回 nil
+func (ipam *IPAM) ReleaseIP(id, ifName, pod string) (net.IP, error) {
+	if err := ipam.store.Lock(); err != nil {
+		return nil, err
+	}
 	defer ipam.store.Unlock()
 
-	if err := ipam.store.LoadData(); err != nil {
+	var ip net.IP
+	err := ipam.retryOnConflict(func() (err error) {
+		ip, err = ipam.releaseIP(id, ifName, pod)
 		return err
+	})
+	return ip, err
+}
+
+// releaseIP 重新加载分配记录并收回 IP，调用方需持有 store 的锁
+func (ipam *IPAM) releaseIP(id, ifName, pod string) (net.IP, error) {
+	if err := ipam.store.LoadData(); err != nil {
+		return nil, err
 	}
 
-	return ipam.store.Del(id)
+	ip, err := ipam.store.Del(id, ifName)
+	if err != nil || ip == nil {
+		return nil, err
+	}
+
+	if ipam.sticky(pod) {
+		if err := ipam.store.Reserve(ip, pod, ifName, time.Now().Add(ipam.stickyGrace)); err != nil {
+			return nil, err
+		}
+	}
+	return ip, nil
 }
 
-// 根据容器 ID，查询并返回它当前被分配的 IP 地址，查不到就返回 err
-func (ipam *IPAM) CheckIP(id string) (net.IP, error) {
-	ipam.store.Lock()
+// 根据容器 ID 与接口名称，查询并返回该接口当前被分配的 IP 地址，查不到就返回 err
+func (ipam *IPAM) CheckIP(id, ifName string) (net.IP, error) {
+	if err := ipam.store.Lock(); err != nil {
+		return nil, err
+	}
 	defer ipam.store.Unlock()
 
 	if err := ipam.store.LoadData(); err != nil {
 		return nil, err
 	}
 
-	ip, ok := ipam.store.GetIPById(id)
+	ip, ok := ipam.store.GetIP(id, ifName)
 	if !ok {
-		return nil, fmt.Errorf("failed to find container %s 's ip", id)
+		return nil, fmt.Errorf("failed to find ip of container %s interface %s", id, ifName)
 	}
 
 	return ip, nil
@@ -0,0 +1,291 @@
+package ipam
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/kerolt/simple-cni/pkg/config"
+	"github.com/kerolt/simple-cni/pkg/store"
+)
+
+const testContainer = "c1"
+
+func newTestIPAM(t *testing.T) (*IPAM, *store.MemoryStore) {
+	t.Helper()
+	s := store.NewMemoryStore()
+	conf := &config.CNIConf{SubnetConf: config.SubnetConf{Subnet: "10.244.1.0/24"}}
+	im, err := NewIPAM(conf, s)
+	if err != nil {
+		t.Fatalf("NewIPAM: %v", err)
+	}
+	return im, s
+}
+
+// TestMultipleInterfaces 同一个容器的 eth0 与 net1 各自分配、查询与释放 IP，互不影响
+func TestMultipleInterfaces(t *testing.T) {
+	ifNames := []string{"eth0", "net1"}
+
+	tests := []struct {
+		name    string
+		release []string // DEL 的接口
+	}{
+		{name: "allocate both", release: nil},
+		{name: "delete eth0", release: []string{"eth0"}},
+		{name: "delete net1", release: []string{"net1"}},
+		{name: "delete both", release: []string{"eth0", "net1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			im, s := newTestIPAM(t)
+
+			ips := make(map[string]net.IP)
+			for _, ifName := range ifNames {
+				ip, err := im.AllocateIP(store.Allocation{ContainerID: testContainer, IfName: ifName}, nil)
+				if err != nil {
+					t.Fatalf("AllocateIP(%s): %v", ifName, err)
+				}
+				ips[ifName] = ip
+			}
+			if ips["eth0"].Equal(ips["net1"]) {
+				t.Fatalf("eth0 and net1 got the same IP %s", ips["eth0"])
+			}
+
+			// 重复的 ADD 返回同一个 IP
+			for _, ifName := range ifNames {
+				ip, err := im.AllocateIP(store.Allocation{ContainerID: testContainer, IfName: ifName}, nil)
+				if err != nil {
+					t.Fatalf("AllocateIP(%s) again: %v", ifName, err)
+				}
+				if !ip.Equal(ips[ifName]) {
+					t.Errorf("AllocateIP(%s) again = %s, want %s", ifName, ip, ips[ifName])
+				}
+			}
+
+			for _, ifName := range tt.release {
+				ip, err := im.ReleaseIP(testContainer, ifName, "")
+				if err != nil {
+					t.Fatalf("ReleaseIP(%s): %v", ifName, err)
+				}
+				if !ip.Equal(ips[ifName]) {
+					t.Errorf("ReleaseIP(%s) = %s, want %s", ifName, ip, ips[ifName])
+				}
+				// 第二次 DEL 什么也不做
+				if ip, err := im.ReleaseIP(testContainer, ifName, ""); err != nil || ip != nil {
+					t.Errorf("ReleaseIP(%s) again = %v, %v, want nil, nil", ifName, ip, err)
+				}
+			}
+
+			for _, ifName := range ifNames {
+				released := slices.Contains(tt.release, ifName)
+
+				ip, ok := s.GetIP(testContainer, ifName)
+				if ok == released || (ok && !ip.Equal(ips[ifName])) {
+					t.Errorf("GetIP(%s) = %s, %v, released %v", ifName, ip, ok, released)
+				}
+
+				ip, err := im.CheckIP(testContainer, ifName)
+				switch {
+				case released && err == nil:
+					t.Errorf("CheckIP(%s) = %s after DEL, want error", ifName, ip)
+				case !released && err != nil:
+					t.Errorf("CheckIP(%s): %v", ifName, err)
+				case !released && !ip.Equal(ips[ifName]):
+					t.Errorf("CheckIP(%s) = %s, want %s", ifName, ip, ips[ifName])
+				}
+			}
+
+			problems, err := im.Validate()
+			if err != nil {
+				t.Fatalf("Validate: %v", err)
+			}
+			if len(problems) != 0 {
+				t.Errorf("Validate() = %q, want no problems", problems)
+			}
+		})
+	}
+}
+
+// TestValidateDuplicateOwner 同一个容器接口有多条分配记录时 Validate 报告重复，不同接口则不报告
+func TestValidateDuplicateOwner(t *testing.T) {
+	type record struct {
+		ip     string
+		ifName string
+	}
+
+	tests := []struct {
+		name    string
+		records []record
+		want    [][]string
+	}{
+		{
+			name:    "different interfaces",
+			records: []record{{"10.244.1.2", "eth0"}, {"10.244.1.3", "net1"}},
+		},
+		{
+			name:    "same interface",
+			records: []record{{"10.244.1.2", "eth0"}, {"10.244.1.3", "eth0"}},
+			want: [][]string{{
+				"interface eth0 of container c1 has both 10.244.1.2 and 10.244.1.3",
+				"interface eth0 of container c1 has both 10.244.1.3 and 10.244.1.2",
+			}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			im, s := newTestIPAM(t)
+			for _, r := range tt.records {
+				if err := s.Add(net.ParseIP(r.ip).To4(), store.Allocation{ContainerID: testContainer, IfName: r.ifName}); err != nil {
+					t.Fatalf("Add(%s): %v", r.ip, err)
+				}
+			}
+
+			problems, err := im.Validate()
+			if err != nil {
+				t.Fatalf("Validate: %v", err)
+			}
+			if !equalProblems(problems, tt.want) {
+				t.Errorf("Validate() = %q, want %q", problems, tt.want)
+			}
+		})
+	}
+}
+
+// equalProblems 比较 Validate 的结果，want 中每个问题列出所有可以接受的写法：
+// Iterate 的顺序不固定，重复记录的两个 IP 可能以任意顺序出现
+func equalProblems(got []string, want [][]string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if !slices.Contains(want[i], got[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// TestStickyReservationNoLongerAllocatable 保留的 IP 被排除或者成为网关之后，Pod 重建时不会再拿回它，保留随之失效
+func TestStickyReservationNoLongerAllocatable(t *testing.T) {
+	const pod = "default/web-0"
+
+	tests := []struct {
+		name   string
+		update func(conf *config.CNIConf, reserved net.IP)
+		reuse  bool
+	}{
+		{name: "unchanged", update: func(*config.CNIConf, net.IP) {}, reuse: true},
+		{name: "excluded", update: func(conf *config.CNIConf, ip net.IP) { conf.Exclude = []string{ip.String()} }},
+		{name: "gateway", update: func(conf *config.CNIConf, ip net.IP) { conf.Gateway = ip.String() }},
+		{name: "out of range", update: func(conf *config.CNIConf, ip net.IP) { conf.RangeStart = "10.244.1.100" }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := store.NewMemoryStore()
+			newConf := func() *config.CNIConf {
+				conf := &config.CNIConf{SubnetConf: config.SubnetConf{Subnet: "10.244.1.0/24"}}
+				conf.StickyIP = &config.StickyIPConf{Enabled: true}
+				return conf
+			}
+			im, err := NewIPAM(newConf(), s)
+			if err != nil {
+				t.Fatalf("NewIPAM: %v", err)
+			}
+
+			alloc := store.Allocation{ContainerID: testContainer, IfName: "eth0", PodNamespace: "default", PodName: "web-0"}
+			reserved, err := im.AllocateIP(alloc, nil)
+			if err != nil {
+				t.Fatalf("AllocateIP: %v", err)
+			}
+			if _, err := im.ReleaseIP(testContainer, "eth0", pod); err != nil {
+				t.Fatalf("ReleaseIP: %v", err)
+			}
+
+			// 网络配置变化后 Pod 以新的容器重建
+			conf := newConf()
+			tt.update(conf, reserved)
+			im, err = NewIPAM(conf, s)
+			if err != nil {
+				t.Fatalf("NewIPAM: %v", err)
+			}
+			alloc.ContainerID = "c2"
+			ip, err := im.AllocateIP(alloc, nil)
+			if err != nil {
+				t.Fatalf("AllocateIP after update: %v", err)
+			}
+
+			if got := ip.Equal(reserved); got != tt.reuse {
+				t.Errorf("AllocateIP() = %s, reserved %s, reuse %v, want %v", ip, reserved, got, tt.reuse)
+			}
+			if !tt.reuse {
+				if _, ok := s.GetReservedIP(pod, "eth0"); ok {
+					t.Errorf("reservation of %s is still valid", reserved)
+				}
+				if !im.allocatable(ip) || !im.ipRange.contains(ip) {
+					t.Errorf("AllocateIP() = %s, which is not allocatable", ip)
+				}
+			}
+		})
+	}
+}
+
+// conflictStore 的前 conflicts 次 Add 返回 store.ErrConflict
+type conflictStore struct {
+	*store.MemoryStore
+	conflicts int
+	loads     int
+}
+
+func (s *conflictStore) LoadData() error {
+	s.loads++
+	return s.MemoryStore.LoadData()
+}
+
+func (s *conflictStore) Add(ip net.IP, alloc store.Allocation) error {
+	if s.conflicts > 0 {
+		s.conflicts--
+		return store.ErrConflict
+	}
+	return s.MemoryStore.Add(ip, alloc)
+}
+
+// TestAllocateIPRetryOnConflict 发生冲突时重新加载记录并重试，超过重试次数后返回 ErrConflict
+func TestAllocateIPRetryOnConflict(t *testing.T) {
+	tests := []struct {
+		name      string
+		conflicts int
+		wantErr   bool
+	}{
+		{name: "no conflict", conflicts: 0},
+		{name: "retried", conflicts: conflictRetries},
+		{name: "too many conflicts", conflicts: conflictRetries + 1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &conflictStore{MemoryStore: store.NewMemoryStore(), conflicts: tt.conflicts}
+			im, err := NewIPAM(&config.CNIConf{SubnetConf: config.SubnetConf{Subnet: "10.244.1.0/24"}}, s)
+			if err != nil {
+				t.Fatalf("NewIPAM: %v", err)
+			}
+
+			ip, err := im.AllocateIP(store.Allocation{ContainerID: testContainer, IfName: "eth0"}, nil)
+			if tt.wantErr {
+				if !errors.Is(err, store.ErrConflict) {
+					t.Fatalf("AllocateIP() = %v, %v, want ErrConflict", ip, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("AllocateIP: %v", err)
+			}
+			if s.loads != tt.conflicts+1 {
+				t.Errorf("LoadData called %d times, want %d", s.loads, tt.conflicts+1)
+			}
+		})
+	}
+}
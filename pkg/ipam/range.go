@@ -0,0 +1,142 @@
+package ipam
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/kerolt/simple-cni/pkg/config"
+
+	cip "github.com/containernetworking/plugins/pkg/ip"
+)
+
+// ipRange 描述子网中可以自动分配的地址范围 [start, end] 以及需要排除的地址
+type ipRange struct {
+	subnet  *net.IPNet
+	start   net.IP
+	end     net.IP
+	exclude []*net.IPNet
+}
+
+func newIPRange(subnet *net.IPNet, conf *config.RangeConf) (*ipRange, error) {
+	r := &ipRange{
+		subnet: subnet,
+		start:  cip.NextIP(subnet.IP),
+		end:    lastIP(subnet),
+	}
+
+	// IPv4 的最后一个地址是广播地址，不能分配
+	if subnet.IP.To4() != nil {
+		r.end = cip.PrevIP(r.end)
+	}
+
+	if conf.RangeStart != "" {
+		start, err := r.parseIP("rangeStart", conf.RangeStart)
+		if err != nil {
+			return nil, err
+		}
+		r.start = start
+	}
+	if conf.RangeEnd != "" {
+		end, err := r.parseIP("rangeEnd", conf.RangeEnd)
+		if err != nil {
+			return nil, err
+		}
+		r.end = end
+	}
+	if cip.Cmp(r.start, r.end) > 0 {
+		return nil, fmt.Errorf("rangeStart %s is after rangeEnd %s", r.start, r.end)
+	}
+
+	for _, e := range conf.Exclude {
+		ipnet, err := parseExclude(e)
+		if err != nil {
+			return nil, err
+		}
+		r.exclude = append(r.exclude, ipnet)
+	}
+
+	return r, nil
+}
+
+// parseIP 解析并校验 rangeStart/rangeEnd，要求位于子网内且不是网络地址或广播地址
+func (r *ipRange) parseIP(field, s string) (net.IP, error) {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid %s %q", field, s)
+	}
+	if !r.subnet.Contains(ip) {
+		return nil, fmt.Errorf("%s %s is not in subnet %s", field, ip, r.subnet)
+	}
+	if r.isReserved(ip) {
+		return nil, fmt.Errorf("%s %s is the network or broadcast address of %s", field, ip, r.subnet)
+	}
+	return normalize(ip), nil
+}
+
+// contains 判断 ip 是否位于 [start, end] 之间
+func (r *ipRange) contains(ip net.IP) bool {
+	return cip.Cmp(ip, r.start) >= 0 && cip.Cmp(ip, r.end) <= 0
+}
+
+// next 返回范围内 ip 的下一个地址，到达 end 之后回到 start
+func (r *ipRange) next(ip net.IP) net.IP {
+	if !r.contains(ip) || cip.Cmp(ip, r.end) >= 0 {
+		return r.start
+	}
+	return cip.NextIP(ip)
+}
+
+// isReserved 判断 ip 是否为子网的网络地址或 IPv4 广播地址
+func (r *ipRange) isReserved(ip net.IP) bool {
+	if ip.Equal(r.subnet.IP) {
+		return true
+	}
+	return r.subnet.IP.To4() != nil && ip.Equal(lastIP(r.subnet))
+}
+
+// isExcluded 判断 ip 是否在 exclude 列表中
+func (r *ipRange) isExcluded(ip net.IP) bool {
+	for _, e := range r.exclude {
+		if e.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseExclude 同时支持单个 IP 与 CIDR 两种写法
+func parseExclude(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exclude %q: %v", s, err)
+		}
+		return ipnet, nil
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid exclude %q", s)
+	}
+	ip = normalize(ip)
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}, nil
+}
+
+// lastIP 返回子网中的最后一个地址
+func lastIP(subnet *net.IPNet) net.IP {
+	ip := normalize(subnet.IP)
+	last := make(net.IP, len(ip))
+	for i := range ip {
+		last[i] = ip[i] | ^subnet.Mask[len(subnet.Mask)-len(ip)+i]
+	}
+	return last
+}
+
+// normalize 将 IPv4 地址统一为 4 字节形式
+func normalize(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
@@ -0,0 +1,253 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net"
+	"path"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	bucketIPs      = "ips"
+	bucketReserved = "reserved"
+	bucketReleased = "released"
+	bucketMeta     = "meta"
+
+	metaLast    = "last"
+	metaVersion = "version"
+)
+
+// BoltStore 是基于嵌入式 KV 数据库 bbolt 的 Backend 实现，数据保存在 <storeDir>/<network>/<network>.db
+//
+// 与 JSON 文件每次修改都重写整个文件不同，BoltStore 只写入发生变化的记录，适合分配记录很多的节点。
+// bbolt 打开数据库时会对文件加排他锁，因此 Lock 打开数据库、Unlock 关闭数据库即可实现进程间互斥
+type BoltStore struct {
+	state
+	dbFile  string
+	db      *bolt.DB
+	saved   *data // 上一次与数据库同步时的数据，用于计算需要写入的差异
+	history *journal
+}
+
+func NewBoltStore(storeDir, networkName string) (*BoltStore, error) {
+	dir, err := ensureDir(storeDir, networkName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BoltStore{
+		state:   state{data: newData()},
+		dbFile:  path.Join(dir, networkName+".db"),
+		saved:   newData(),
+		history: newJournal(dir, networkName),
+	}, nil
+}
+
+func (s *BoltStore) Lock() error {
+	db, err := bolt.Open(s.dbFile, 0600, nil)
+	if err != nil {
+		return err
+	}
+	s.db = db
+	return nil
+}
+
+func (s *BoltStore) Unlock() error {
+	if s.db == nil {
+		return nil
+	}
+	err := s.db.Close()
+	s.db = nil
+	return err
+}
+
+func (s *BoltStore) Close() error {
+	return s.Unlock()
+}
+
+// LoadData 从数据库中读取所有记录
+func (s *BoltStore) LoadData() error {
+	if s.db == nil {
+		return fmt.Errorf("bolt store %s is not locked", s.dbFile)
+	}
+
+	data := newData()
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if err := loadBucket(tx, bucketIPs, data.IPs); err != nil {
+			return err
+		}
+		if err := loadBucket(tx, bucketReserved, data.Reserved); err != nil {
+			return err
+		}
+		if err := loadBucket(tx, bucketReleased, data.Released); err != nil {
+			return err
+		}
+		if b := tx.Bucket([]byte(bucketMeta)); b != nil {
+			data.Last = string(b.Get([]byte(metaLast)))
+			if v := b.Get([]byte(metaVersion)); v != nil {
+				if err := json.Unmarshal(v, &data.Version); err != nil {
+					return fmt.Errorf("invalid store schema version %q: %v", v, err)
+				}
+			}
+		}
+		return checkVersion(data.Version)
+	})
+	if err != nil {
+		return err
+	}
+
+	s.data = data
+	s.saved = cloneData(data)
+	return nil
+}
+
+// save 只把与上一次同步相比发生变化的记录写入数据库
+func (s *BoltStore) save() error {
+	if s.db == nil {
+		return fmt.Errorf("bolt store %s is not locked", s.dbFile)
+	}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if err := syncBucket(tx, bucketIPs, s.saved.IPs, s.data.IPs); err != nil {
+			return err
+		}
+		if err := syncBucket(tx, bucketReserved, s.saved.Reserved, s.data.Reserved); err != nil {
+			return err
+		}
+		if err := syncBucket(tx, bucketReleased, s.saved.Released, s.data.Released); err != nil {
+			return err
+		}
+
+		b, err := tx.CreateBucketIfNotExists([]byte(bucketMeta))
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte(metaVersion), []byte(strconv.Itoa(s.data.Version))); err != nil {
+			return err
+		}
+		return b.Put([]byte(metaLast), []byte(s.data.Last))
+	})
+	if err != nil {
+		return err
+	}
+
+	s.saved = cloneData(s.data)
+	return nil
+}
+
+// Add 添加一个新的 IP 分配记录，并写入历史记录
+func (s *BoltStore) Add(ip net.IP, alloc Allocation) error {
+	if err := s.data.add(ip, alloc); err != nil {
+		return err
+	}
+	if err := s.save(); err != nil {
+		return err
+	}
+	s.history.record(EventAllocate, ip, s.data.IPs[ip.String()])
+	return nil
+}
+
+// Del 删除容器 id 的 ifName 接口的 IP 分配记录，返回被删除的 IP
+func (s *BoltStore) Del(id, ifName string) (net.IP, error) {
+	ip, alloc := s.data.del(id, ifName)
+	if ip == nil {
+		return nil, nil
+	}
+	if err := s.save(); err != nil {
+		return nil, err
+	}
+	s.history.record(EventRelease, ip, alloc)
+	return ip, nil
+}
+
+// DelIP 删除 ip 的分配记录，返回记录是否存在
+func (s *BoltStore) DelIP(ip net.IP) (bool, error) {
+	alloc, ok := s.data.delIP(ip)
+	if !ok {
+		return false, nil
+	}
+	if err := s.save(); err != nil {
+		return false, err
+	}
+	s.history.record(EventRelease, ip, alloc)
+	return true, nil
+}
+
+// restore 用 d 整体替换数据并写入数据库，用于导入
+func (s *BoltStore) restore(d *data) error {
+	s.data = d
+	return s.save()
+}
+
+// Reserve 在 expires 之前为 Pod 保留 IP
+func (s *BoltStore) Reserve(ip net.IP, pod, ifName string, expires time.Time) error {
+	if err := s.data.reserve(ip, pod, ifName, expires); err != nil {
+		return err
+	}
+	return s.save()
+}
+
+// loadBucket 将 bucket 中的 JSON 记录读取到 m 中，bucket 不存在时什么也不做
+func loadBucket[T any](tx *bolt.Tx, name string, m map[string]T) error {
+	b := tx.Bucket([]byte(name))
+	if b == nil {
+		return nil
+	}
+
+	return b.ForEach(func(k, v []byte) error {
+		var val T
+		if err := json.Unmarshal(v, &val); err != nil {
+			return fmt.Errorf("invalid record %s/%s: %v", name, k, err)
+		}
+		m[string(k)] = val
+		return nil
+	})
+}
+
+// syncBucket 对比 old 与 cur，删除已不存在的记录并写入新增或变化的记录
+func syncBucket[T any](tx *bolt.Tx, name string, old, cur map[string]T) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(name))
+	if err != nil {
+		return err
+	}
+
+	for k := range old {
+		if _, ok := cur[k]; !ok {
+			if err := b.Delete([]byte(k)); err != nil {
+				return err
+			}
+		}
+	}
+
+	for k, v := range cur {
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if o, ok := old[k]; ok {
+			if oraw, err := json.Marshal(o); err == nil && bytes.Equal(raw, oraw) {
+				continue
+			}
+		}
+		if err := b.Put([]byte(k), raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func cloneData(d *data) *data {
+	return &data{
+		Version:  d.Version,
+		IPs:      maps.Clone(d.IPs),
+		Last:     d.Last,
+		Reserved: maps.Clone(d.Reserved),
+		Released: maps.Clone(d.Released),
+	}
+}
@@ -0,0 +1,299 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// DocumentKind 是导出文档的类型标识
+	DocumentKind = "simple-cni-ipam"
+
+	// DocumentVersion 是导出文档外层格式的版本，data 部分的格式由其中的 version（SchemaVersion）描述
+	DocumentVersion = 1
+
+	// hostLocalLastIP 是 host-local 记录最近分配的 IP 的文件
+	hostLocalLastIP = "last_reserved_ip.0"
+)
+
+// ErrImportConflict 表示导入的数据与 store 中已有的记录冲突
+var ErrImportConflict = errors.New("import conflicts with existing allocations")
+
+// Document 是可移植的 store 导出文档，用于备份、迁移数据目录或重建节点
+type Document struct {
+	Kind       string          `json:"kind"`
+	Version    int             `json:"version"`
+	Network    string          `json:"network"`
+	ExportedAt time.Time       `json:"exportedAt"`
+	Data       json.RawMessage `json:"data"` // 与数据文件相同的格式，导入时按 version 升级到 SchemaVersion
+}
+
+// ImportOptions 导入时的选项
+type ImportOptions struct {
+	Subnet        *net.IPNet // 不为 nil 时拒绝导入子网之外的 IP
+	Force         bool       // 发生冲突时以导入的数据为准覆盖已有记录
+	DryRun        bool       // 只检查冲突，不写入
+	IgnoreNetwork bool       // 允许导入其他网络导出的文档
+}
+
+// Conflict 是导入时发现的一处冲突
+type Conflict struct {
+	IP     string `json:"ip"`
+	Reason string `json:"reason"`
+}
+
+// ImportResult 是导入的结果
+type ImportResult struct {
+	Imported  int        `json:"imported"`  // 新增或覆盖的分配记录数
+	Skipped   int        `json:"skipped"`   // store 中已经存在、完全相同的分配记录数
+	Reserved  int        `json:"reserved"`  // 导入的保留记录数
+	Conflicts []Conflict `json:"conflicts"` // 发现的冲突，Force 时冲突的记录已被覆盖
+}
+
+// snapshotter 与 restorer 由包内的所有后端实现，用于整体读取与替换数据
+type snapshotter interface {
+	snapshot() *data
+}
+
+type restorer interface {
+	restore(d *data) error
+}
+
+// snapshot 返回当前数据的副本
+func (st *state) snapshot() *data {
+	return cloneData(st.data)
+}
+
+// Export 导出 b 中 network 的所有数据
+func Export(b Backend, network string) (*Document, error) {
+	if err := b.Lock(); err != nil {
+		return nil, err
+	}
+	defer b.Unlock()
+
+	if err := b.LoadData(); err != nil {
+		return nil, err
+	}
+
+	s, ok := b.(snapshotter)
+	if !ok {
+		return nil, fmt.Errorf("store backend %T does not support export", b)
+	}
+	return newDocument(network, s.snapshot())
+}
+
+func newDocument(network string, d *data) (*Document, error) {
+	raw, err := json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	return &Document{
+		Kind:       DocumentKind,
+		Version:    DocumentVersion,
+		Network:    network,
+		ExportedAt: time.Now().UTC(),
+		Data:       raw,
+	}, nil
+}
+
+// Import 把文档中的数据合并到 b 中
+//
+// store 中已有的同一个 IP 分配给了其他接口、或同一个接口已经有其他 IP 时视为冲突。没有 Force 时只要有冲突就不做任何修改，
+// 返回 ErrImportConflict 与冲突列表；Force 时以文档为准覆盖冲突的记录
+func Import(b Backend, network string, doc *Document, opts ImportOptions) (*ImportResult, error) {
+	if doc.Kind != DocumentKind {
+		return nil, fmt.Errorf("unknown document kind %q", doc.Kind)
+	}
+	if doc.Version > DocumentVersion {
+		return nil, fmt.Errorf("document version %d is newer than supported version %d", doc.Version, DocumentVersion)
+	}
+	if doc.Network != network && !opts.IgnoreNetwork {
+		return nil, fmt.Errorf("document is for network %q, not %q", doc.Network, network)
+	}
+
+	in, _, err := decodeData(doc.Data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid document data: %w", err)
+	}
+
+	if err := b.Lock(); err != nil {
+		return nil, err
+	}
+	defer b.Unlock()
+
+	if err := b.LoadData(); err != nil {
+		return nil, err
+	}
+
+	s, ok := b.(interface {
+		snapshotter
+		restorer
+	})
+	if !ok {
+		return nil, fmt.Errorf("store backend %T does not support import", b)
+	}
+
+	merged := s.snapshot()
+	result := merge(merged, in, opts)
+
+	if len(result.Conflicts) > 0 && !opts.Force {
+		return result, ErrImportConflict
+	}
+	if opts.DryRun {
+		return result, nil
+	}
+	return result, s.restore(merged)
+}
+
+// merge 把 in 合并到 d 中并返回合并结果
+func merge(d, in *data, opts ImportOptions) *ImportResult {
+	result := &ImportResult{Conflicts: []Conflict{}}
+	conflict := func(ip, format string, args ...any) {
+		result.Conflicts = append(result.Conflicts, Conflict{IP: ip, Reason: fmt.Sprintf(format, args...)})
+	}
+
+	inSubnet := func(ip string) bool {
+		if opts.Subnet == nil || opts.Subnet.Contains(net.ParseIP(ip)) {
+			return true
+		}
+		conflict(ip, "not in subnet %s", opts.Subnet)
+		return false
+	}
+
+	for _, ip := range sortedKeys(in.IPs) {
+		alloc := in.IPs[ip]
+		if !inSubnet(ip) {
+			continue
+		}
+
+		conflicted := false
+		if cur, ok := d.IPs[ip]; ok {
+			if cur.Match(alloc.ContainerID, alloc.IfName) {
+				result.Skipped++
+				continue
+			}
+			conflict(ip, "allocated to container %s interface %s", cur.ContainerID, cur.IfName)
+			conflicted = true
+		}
+		for other, cur := range d.IPs {
+			if other != ip && cur.Match(alloc.ContainerID, alloc.IfName) {
+				conflict(ip, "container %s interface %s already has IP %s", alloc.ContainerID, alloc.IfName, other)
+				conflicted = true
+				if opts.Force {
+					delete(d.IPs, other)
+				}
+			}
+		}
+		if conflicted && !opts.Force {
+			continue
+		}
+
+		d.IPs[ip] = alloc
+		delete(d.Reserved, ip)
+		delete(d.Released, ip)
+		result.Imported++
+	}
+
+	now := time.Now()
+	for _, ip := range sortedKeys(in.Reserved) {
+		r := in.Reserved[ip]
+		if !now.Before(r.Expires) || !inSubnet(ip) {
+			continue
+		}
+		if _, ok := d.IPs[ip]; ok {
+			continue
+		}
+		if cur, ok := d.Reserved[ip]; ok && now.Before(cur.Expires) && cur.Pod != r.Pod {
+			conflict(ip, "reserved for pod %s", cur.Pod)
+			if !opts.Force {
+				continue
+			}
+		}
+		d.Reserved[ip] = r
+		result.Reserved++
+	}
+
+	for ip, t := range in.Released {
+		if _, ok := d.IPs[ip]; ok {
+			continue
+		}
+		if cur, ok := d.Released[ip]; !ok || t.After(cur) {
+			d.Released[ip] = t
+		}
+	}
+
+	if d.Last == "" {
+		d.Last = in.Last
+	}
+	return result
+}
+
+// ReadHostLocal 读取 host-local IPAM 的数据目录（/var/lib/cni/networks/<network>），转换为导出文档
+//
+// host-local 为每个 IP 保存一个以 IP 命名的文件，内容是 "<容器 ID>\r\n<接口名>"，早期版本只有容器 ID
+func ReadHostLocal(dir string) (*Document, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	d := newData()
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		name := entry.Name()
+		if name == hostLocalLastIP {
+			raw, err := os.ReadFile(filepath.Join(dir, name))
+			if err != nil {
+				return nil, err
+			}
+			if ip := net.ParseIP(strings.TrimSpace(string(raw))); ip != nil {
+				d.Last = ip.String()
+			}
+			continue
+		}
+
+		// 其他文件（lock 等）不是分配记录
+		ip := net.ParseIP(name)
+		if ip == nil {
+			continue
+		}
+
+		raw, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		lines := strings.Split(strings.ReplaceAll(string(raw), "\r\n", "\n"), "\n")
+		alloc := Allocation{ContainerID: strings.TrimSpace(lines[0]), IfName: "eth0"}
+		if len(lines) > 1 && strings.TrimSpace(lines[1]) != "" {
+			alloc.IfName = strings.TrimSpace(lines[1])
+		}
+		if alloc.ContainerID == "" {
+			return nil, fmt.Errorf("host-local allocation %s has no container ID", name)
+		}
+		if info, err := entry.Info(); err == nil {
+			alloc.AllocatedAt = info.ModTime().UTC()
+		}
+		d.IPs[ip.String()] = alloc
+	}
+
+	return newDocument(filepath.Base(filepath.Clean(dir)), d)
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
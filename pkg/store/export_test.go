@@ -0,0 +1,247 @@
+package store
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// owners 返回 IP 到 "<容器 ID>/<接口名>" 的映射，便于比较
+func owners(d *data) map[string]string {
+	m := make(map[string]string)
+	for ip, alloc := range d.IPs {
+		m[ip] = alloc.ContainerID + "/" + alloc.IfName
+	}
+	return m
+}
+
+// ownedBy 返回 "<容器 ID>/<接口名>" 对应的分配记录
+func ownedBy(owner string) Allocation {
+	id, ifName, _ := strings.Cut(owner, "/")
+	return Allocation{ContainerID: id, IfName: ifName}
+}
+
+// newTestDocument 用 ips（IP 到 "<容器 ID>/<接口名>"）构造 testNetwork 的导出文档
+func newTestDocument(t *testing.T, ips map[string]string) *Document {
+	t.Helper()
+	d := newData()
+	for ip, owner := range ips {
+		d.IPs[ip] = ownedBy(owner)
+	}
+	doc, err := newDocument(testNetwork, d)
+	if err != nil {
+		t.Fatalf("newDocument: %v", err)
+	}
+	return doc
+}
+
+// TestImport 导入时检测冲突，Force 以导入的数据为准，DryRun 不修改 store
+func TestImport(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.244.1.0/24")
+	existing := map[string]string{"10.244.1.2": "c1/eth0", "10.244.1.3": "c2/eth0"}
+
+	tests := []struct {
+		name          string
+		doc           map[string]string
+		opts          ImportOptions
+		wantErr       error
+		wantImported  int
+		wantSkipped   int
+		wantConflicts []string // 冲突的 IP
+		want          map[string]string
+	}{
+		{
+			name:         "new and identical",
+			doc:          map[string]string{"10.244.1.2": "c1/eth0", "10.244.1.4": "c3/eth0"},
+			wantImported: 1,
+			wantSkipped:  1,
+			want:         map[string]string{"10.244.1.2": "c1/eth0", "10.244.1.3": "c2/eth0", "10.244.1.4": "c3/eth0"},
+		},
+		{
+			name:          "ip allocated to another container",
+			doc:           map[string]string{"10.244.1.2": "c3/eth0", "10.244.1.4": "c4/eth0"},
+			wantErr:       ErrImportConflict,
+			wantImported:  1,
+			wantConflicts: []string{"10.244.1.2"},
+			want:          existing,
+		},
+		{
+			name:          "interface already has another ip",
+			doc:           map[string]string{"10.244.1.4": "c1/eth0"},
+			wantErr:       ErrImportConflict,
+			wantConflicts: []string{"10.244.1.4"},
+			want:          existing,
+		},
+		{
+			name:          "force",
+			doc:           map[string]string{"10.244.1.2": "c3/eth0", "10.244.1.4": "c2/eth0"},
+			opts:          ImportOptions{Force: true},
+			wantImported:  2,
+			wantConflicts: []string{"10.244.1.2", "10.244.1.4"},
+			want:          map[string]string{"10.244.1.2": "c3/eth0", "10.244.1.4": "c2/eth0"},
+		},
+		{
+			name:         "dry run",
+			doc:          map[string]string{"10.244.1.4": "c3/eth0"},
+			opts:         ImportOptions{DryRun: true},
+			wantImported: 1,
+			want:         existing,
+		},
+		{
+			name:          "dry run with force",
+			doc:           map[string]string{"10.244.1.2": "c3/eth0"},
+			opts:          ImportOptions{DryRun: true, Force: true},
+			wantImported:  1,
+			wantConflicts: []string{"10.244.1.2"},
+			want:          existing,
+		},
+		{
+			name:          "out of subnet",
+			doc:           map[string]string{"10.244.2.2": "c3/eth0"},
+			opts:          ImportOptions{Subnet: subnet},
+			wantErr:       ErrImportConflict,
+			wantConflicts: []string{"10.244.2.2"},
+			want:          existing,
+		},
+		{
+			// Force 只覆盖冲突的记录，子网之外的 IP 仍然不会导入
+			name:          "out of subnet with force",
+			doc:           map[string]string{"10.244.2.2": "c3/eth0", "10.244.1.4": "c4/eth0"},
+			opts:          ImportOptions{Subnet: subnet, Force: true},
+			wantImported:  1,
+			wantConflicts: []string{"10.244.2.2"},
+			want:          map[string]string{"10.244.1.2": "c1/eth0", "10.244.1.3": "c2/eth0", "10.244.1.4": "c4/eth0"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewMemoryStore()
+			for ip, owner := range existing {
+				if err := s.Add(net.ParseIP(ip).To4(), ownedBy(owner)); err != nil {
+					t.Fatalf("Add(%s): %v", ip, err)
+				}
+			}
+
+			result, err := Import(s, testNetwork, newTestDocument(t, tt.doc), tt.opts)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Import() error = %v, want %v", err, tt.wantErr)
+			}
+			if result.Imported != tt.wantImported || result.Skipped != tt.wantSkipped {
+				t.Errorf("Import() imported %d, skipped %d, want %d, %d", result.Imported, result.Skipped, tt.wantImported, tt.wantSkipped)
+			}
+			var conflicts []string
+			for _, c := range result.Conflicts {
+				conflicts = append(conflicts, c.IP)
+			}
+			if !reflect.DeepEqual(conflicts, tt.wantConflicts) {
+				t.Errorf("Import() conflicts = %v, want %v", result.Conflicts, tt.wantConflicts)
+			}
+			if got := owners(s.snapshot()); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("store after Import() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestImportDocument 拒绝未知类型的文档与其他网络导出的文档
+func TestImportDocument(t *testing.T) {
+	tests := []struct {
+		name    string
+		update  func(doc *Document)
+		opts    ImportOptions
+		wantErr bool
+	}{
+		{name: "unknown kind", update: func(doc *Document) { doc.Kind = "host-local" }, wantErr: true},
+		{name: "newer version", update: func(doc *Document) { doc.Version = DocumentVersion + 1 }, wantErr: true},
+		{name: "other network", update: func(doc *Document) { doc.Network = "other" }, wantErr: true},
+		{name: "ignore network", update: func(doc *Document) { doc.Network = "other" }, opts: ImportOptions{IgnoreNetwork: true}},
+		{name: "newer schema", update: func(doc *Document) { doc.Data = []byte(`{"version":100,"ips":{}}`) }, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := newTestDocument(t, map[string]string{"10.244.1.2": "c1/eth0"})
+			tt.update(doc)
+			if _, err := Import(NewMemoryStore(), testNetwork, doc, tt.opts); (err != nil) != tt.wantErr {
+				t.Errorf("Import() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestExportImport 导出的文档可以原样导入到空的 store
+func TestExportImport(t *testing.T) {
+	src := NewMemoryStore()
+	if err := src.Add(testIP1, Allocation{ContainerID: "c1", IfName: "eth0", PodNamespace: "default", PodName: "web-0"}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	doc, err := Export(src, testNetwork)
+	if err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+
+	dst := NewMemoryStore()
+	if _, err := Import(dst, testNetwork, doc, ImportOptions{}); err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+	if !reflect.DeepEqual(dst.snapshot(), src.snapshot()) {
+		t.Errorf("imported data = %+v, want %+v", dst.snapshot(), src.snapshot())
+	}
+}
+
+// TestReadHostLocal 读取 host-local 的数据目录，兼容只记录了容器 ID 的旧格式
+func TestReadHostLocal(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "k8s-pod-network")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	files := map[string]string{
+		"10.244.1.2":    "c1\r\neth0",
+		"10.244.1.3":    "c2\r\nnet1",
+		"10.244.1.4":    "c3", // 早期版本只有容器 ID
+		hostLocalLastIP: "10.244.1.4\n",
+		"lock":          "",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+
+	doc, err := ReadHostLocal(dir)
+	if err != nil {
+		t.Fatalf("ReadHostLocal: %v", err)
+	}
+	if doc.Network != "k8s-pod-network" {
+		t.Errorf("network = %q, want %q", doc.Network, "k8s-pod-network")
+	}
+	d, _, err := decodeData(doc.Data)
+	if err != nil {
+		t.Fatalf("decodeData: %v", err)
+	}
+	want := map[string]string{"10.244.1.2": "c1/eth0", "10.244.1.3": "c2/net1", "10.244.1.4": "c3/eth0"}
+	if got := owners(d); !reflect.DeepEqual(got, want) {
+		t.Errorf("allocations = %v, want %v", got, want)
+	}
+	if d.Last != "10.244.1.4" {
+		t.Errorf("last = %q, want %q", d.Last, "10.244.1.4")
+	}
+	for ip, alloc := range d.IPs {
+		if alloc.AllocatedAt.IsZero() {
+			t.Errorf("allocation of %s has no AllocatedAt", ip)
+		}
+	}
+
+	// 没有容器 ID 的记录无法导入
+	if err := os.WriteFile(filepath.Join(dir, "10.244.1.5"), []byte("\r\neth0"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if _, err := ReadHostLocal(dir); err == nil {
+		t.Error("ReadHostLocal() succeeded with an empty container ID, want error")
+	}
+}
@@ -0,0 +1,290 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path"
+	"time"
+
+	"github.com/alexflint/go-filemutex"
+)
+
+// CNI 插件通常会被多个进程（不同容器的配置/解绑操作）并发调用，多个进程可能同时访问同一个 network 的 data 文件（network.json）。如果没有进程间锁，两个进程同时写入会产生竞态（race）或写入不完整/损坏的 JSON 文件。
+func newFileLock(lockPath string) (*filemutex.FileMutex, error) {
+	fileInfo, err := os.Stat(lockPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if fileInfo.IsDir() {
+		lockPath = path.Join(lockPath, "lock")
+	}
+
+	fm, err := filemutex.New(lockPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return fm, nil
+}
+
+// RecoveredContainerID 是从现存网络接口重建出来的分配记录使用的容器 ID
+const RecoveredContainerID = "recovered"
+
+// RecoverFunc 返回节点上当前仍在使用的 IP，用于在数据文件与备份都损坏时重建 store
+type RecoverFunc func() ([]net.IP, error)
+
+// Store 是基于 JSON 文件的 Backend 实现，数据保存在 <storeDir>/<network>/<network>.json
+type Store struct {
+	*filemutex.FileMutex
+	state
+	dir         string
+	dataFile    string
+	history     *journal
+	recoverFunc RecoverFunc
+}
+
+func NewStore(storeDir, networkName string) (*Store, error) {
+	dir, err := ensureDir(storeDir, networkName)
+	if err != nil {
+		return nil, err
+	}
+
+	fl, err := newFileLock(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	dataFile := path.Join(dir, networkName+".json")
+
+	return &Store{
+		FileMutex: fl,
+		state:     state{data: newData()},
+		dir:       dir,
+		dataFile:  dataFile,
+		history:   newJournal(dir, networkName),
+	}, nil
+}
+
+// LoadData 从 json 文件中读取数据到 s.data
+//
+// 数据文件损坏（如写入过程中宕机）时会从备份文件恢复，并通过 RecoverFunc 从现存的网络接口补全，
+// 恢复后的数据会立即写回数据文件，损坏的文件另存为 <network>.json.corrupt-<时间戳> 以便排查
+func (s *Store) LoadData() error {
+	data, from, err := readData(s.dataFile)
+	if os.IsNotExist(err) {
+		// 文件不存在则创建
+		s.data = newData()
+		return s.Save()
+	}
+
+	// 更新版本的插件写入的数据不能当作损坏处理，否则会被旧数据覆盖
+	var tooNew *ErrSchemaTooNew
+	if errors.As(err, &tooNew) {
+		return fmt.Errorf("store %s: %w", s.dataFile, err)
+	}
+
+	if err != nil {
+		log.Printf("ERROR: store %s is corrupt: %v", s.dataFile, err)
+		if data, err = s.recoverData(); err != nil {
+			return err
+		}
+		s.data = data
+		return s.Save()
+	}
+
+	s.data = data
+
+	// 旧版本的数据在持有文件锁的情况下原地升级，升级前的文件保留为备份
+	if from < SchemaVersion {
+		log.Printf("WARNING: migrating store %s from schema version %d to %d", s.dataFile, from, SchemaVersion)
+		return s.Save()
+	}
+	return nil
+}
+
+// Verify 只读地检查数据文件能否解析，返回文件中数据的版本，不会恢复、升级或改写数据文件
+func (s *Store) Verify() (int, error) {
+	_, from, err := readData(s.dataFile)
+	return from, err
+}
+
+// recoverData 在数据文件损坏时恢复数据：先读取备份文件，再通过 RecoverFunc 补上备份中缺失的 IP
+func (s *Store) recoverData() (*data, error) {
+	corrupt := fmt.Sprintf("%s.corrupt-%d", s.dataFile, time.Now().Unix())
+	if err := os.Rename(s.dataFile, corrupt); err != nil {
+		return nil, err
+	}
+	log.Printf("ERROR: moved corrupt store file to %s", corrupt)
+
+	data, _, err := readData(s.backupFile())
+	if err == nil {
+		log.Printf("WARNING: recovered store %s from backup %s", s.dataFile, s.backupFile())
+	} else {
+		log.Printf("ERROR: backup %s is not usable: %v", s.backupFile(), err)
+		data = newData()
+	}
+
+	if s.recoverFunc == nil {
+		log.Printf("WARNING: no way to rebuild store %s from live interfaces, allocations may be lost", s.dataFile)
+		return data, nil
+	}
+
+	// 备份之后分配出去的 IP 只能从现存的网络接口中找回
+	ips, err := s.recoverFunc()
+	if err != nil {
+		return nil, fmt.Errorf("failed to rebuild store %s from live interfaces: %v", s.dataFile, err)
+	}
+	recovered := 0
+	for _, ip := range ips {
+		if _, ok := data.IPs[ip.String()]; !ok {
+			// 记录恢复的时间，节点 GC 至少等待一个 grace 周期才会回收
+			data.IPs[ip.String()] = Allocation{ContainerID: RecoveredContainerID, AllocatedAt: time.Now().UTC()}
+			recovered++
+		}
+	}
+	log.Printf("WARNING: rebuilt store %s from live interfaces, %d IPs marked as %q", s.dataFile, recovered, RecoveredContainerID)
+	return data, nil
+}
+
+// SetRecoverFunc 设置数据文件与备份都不可用时，用来重建已分配 IP 的函数
+func (s *Store) SetRecoverFunc(fn RecoverFunc) {
+	s.recoverFunc = fn
+}
+
+func (s *Store) backupFile() string {
+	return s.dataFile + ".bak"
+}
+
+// readData 读取并解析数据文件，空文件同样视为损坏，旧版本的数据会被升级到 SchemaVersion
+//
+// 返回的 from 是文件中数据原来的版本
+func readData(file string) (*data, int, error) {
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(raw) == 0 {
+		return nil, 0, fmt.Errorf("empty file")
+	}
+
+	return decodeData(raw)
+}
+
+// Save 将 s.data 保存到 json 文件中
+//
+// 先写入临时文件并 fsync，再通过 rename 原子地替换数据文件，避免宕机时留下写了一半的 JSON。
+// 替换前的数据文件会保留为 <network>.json.bak，作为损坏时恢复用的备份
+func (s *Store) Save() error {
+	raw, err := json.Marshal(s.data)
+	if err != nil {
+		return err
+	}
+
+	// 任何一步失败都删除临时文件，rename 成功之后它已经不存在
+	tmpFile := s.dataFile + ".tmp"
+	defer os.Remove(tmpFile)
+	if err := writeFileSync(tmpFile, raw, 0600); err != nil {
+		return err
+	}
+
+	// 用硬链接保留旧的数据文件，rename 之后备份仍然指向旧内容
+	if _, err := os.Stat(s.dataFile); err == nil {
+		if err := os.Remove(s.backupFile()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Link(s.dataFile, s.backupFile()); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Rename(tmpFile, s.dataFile); err != nil {
+		return err
+	}
+
+	return syncDir(s.dir)
+}
+
+// writeFileSync 写入文件并确保内容落盘
+func writeFileSync(name string, raw []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(raw); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir 对目录执行 fsync，使 rename 的结果持久化
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Add 添加一个新的 IP 分配记录，并写入历史记录
+func (s *Store) Add(ip net.IP, alloc Allocation) error {
+	if err := s.data.add(ip, alloc); err != nil {
+		return err
+	}
+	if err := s.Save(); err != nil {
+		return err
+	}
+	s.history.record(EventAllocate, ip, s.data.IPs[ip.String()])
+	return nil
+}
+
+// Del 删除容器 id 的 ifName 接口的 IP 分配记录，返回被删除的 IP
+func (s *Store) Del(id, ifName string) (net.IP, error) {
+	ip, alloc := s.data.del(id, ifName)
+	if ip == nil {
+		return nil, nil
+	}
+	if err := s.Save(); err != nil {
+		return nil, err
+	}
+	s.history.record(EventRelease, ip, alloc)
+	return ip, nil
+}
+
+// DelIP 删除 ip 的分配记录，返回记录是否存在
+func (s *Store) DelIP(ip net.IP) (bool, error) {
+	alloc, ok := s.data.delIP(ip)
+	if !ok {
+		return false, nil
+	}
+	if err := s.Save(); err != nil {
+		return false, err
+	}
+	s.history.record(EventRelease, ip, alloc)
+	return true, nil
+}
+
+// restore 用 d 整体替换数据并保存，用于导入
+func (s *Store) restore(d *data) error {
+	s.data = d
+	return s.Save()
+}
+
+// Reserve 在 expires 之前为 Pod 保留 IP，保留期间该 IP 不会分配给其他 Pod
+func (s *Store) Reserve(ip net.IP, pod, ifName string, expires time.Time) error {
+	if err := s.data.reserve(ip, pod, ifName, expires); err != nil {
+		return err
+	}
+	return s.Save()
+}
@@ -0,0 +1,232 @@
+package store
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testNetwork = "test"
+
+var (
+	testIP1 = net.ParseIP("10.244.1.2").To4()
+	testIP2 = net.ParseIP("10.244.1.3").To4()
+	testIP3 = net.ParseIP("10.244.1.4").To4()
+)
+
+// newTestStore 创建数据文件，依次分配 testIP1 与 testIP2，此时备份中只有 testIP1
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+	s, err := NewStore(t.TempDir(), testNetwork)
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	if err := s.LoadData(); err != nil {
+		t.Fatalf("LoadData: %v", err)
+	}
+	if err := s.Add(testIP1, Allocation{ContainerID: "c1", IfName: "eth0"}); err != nil {
+		t.Fatalf("Add(%s): %v", testIP1, err)
+	}
+	if err := s.Add(testIP2, Allocation{ContainerID: "c2", IfName: "eth0"}); err != nil {
+		t.Fatalf("Add(%s): %v", testIP2, err)
+	}
+	return s
+}
+
+// reopen 用同一个数据目录创建新的 Store 并加载数据，模拟下一次插件调用
+func reopen(t *testing.T, s *Store, fn RecoverFunc) (*Store, error) {
+	t.Helper()
+	s2, err := NewStore(filepath.Dir(s.dir), testNetwork)
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	s2.SetRecoverFunc(fn)
+	return s2, s2.LoadData()
+}
+
+func corruptFile(t *testing.T, name string) {
+	t.Helper()
+	raw, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if err := os.WriteFile(name, raw[:len(raw)/2], 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+}
+
+// TestLoadDataCorrupt 数据文件损坏时从备份恢复，损坏的文件被另存，恢复后的数据写回数据文件
+func TestLoadDataCorrupt(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(t *testing.T, name string)
+	}{
+		{name: "truncated", corrupt: corruptFile},
+		{name: "empty", corrupt: func(t *testing.T, name string) {
+			if err := os.Truncate(name, 0); err != nil {
+				t.Fatalf("Truncate: %v", err)
+			}
+		}},
+		{name: "garbage", corrupt: func(t *testing.T, name string) {
+			if err := os.WriteFile(name, []byte("not json"), 0600); err != nil {
+				t.Fatalf("WriteFile: %v", err)
+			}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestStore(t)
+			tt.corrupt(t, s.dataFile)
+
+			s2, err := reopen(t, s, nil)
+			if err != nil {
+				t.Fatalf("LoadData: %v", err)
+			}
+			if !s2.Contain(testIP1) {
+				t.Errorf("%s from the backup is missing", testIP1)
+			}
+			// 备份之后分配的 IP 没有 RecoverFunc 就找不回来
+			if s2.Contain(testIP2) {
+				t.Errorf("%s is not in the backup but was recovered", testIP2)
+			}
+
+			corrupt, err := filepath.Glob(s.dataFile + ".corrupt-*")
+			if err != nil || len(corrupt) != 1 {
+				t.Errorf("corrupt files = %v, %v, want one", corrupt, err)
+			}
+			if _, _, err := readData(s.dataFile); err != nil {
+				t.Errorf("data file is still unreadable after recovery: %v", err)
+			}
+		})
+	}
+}
+
+// TestLoadDataRecoverFunc 通过 RecoverFunc 补上备份中缺失的 IP，备份中已有的记录保持原来的容器
+func TestLoadDataRecoverFunc(t *testing.T) {
+	live := func() ([]net.IP, error) { return []net.IP{testIP1, testIP2, testIP3}, nil }
+
+	tests := []struct {
+		name          string
+		corruptBackup bool
+		want          map[string]string // IP 到容器 ID
+	}{
+		{
+			name: "backup usable",
+			want: map[string]string{
+				testIP1.String(): "c1",
+				testIP2.String(): RecoveredContainerID,
+				testIP3.String(): RecoveredContainerID,
+			},
+		},
+		{
+			name:          "backup corrupt",
+			corruptBackup: true,
+			want: map[string]string{
+				testIP1.String(): RecoveredContainerID,
+				testIP2.String(): RecoveredContainerID,
+				testIP3.String(): RecoveredContainerID,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestStore(t)
+			corruptFile(t, s.dataFile)
+			if tt.corruptBackup {
+				corruptFile(t, s.backupFile())
+			}
+
+			s2, err := reopen(t, s, live)
+			if err != nil {
+				t.Fatalf("LoadData: %v", err)
+			}
+
+			got := make(map[string]string)
+			s2.Iterate(func(ip net.IP, alloc Allocation) bool {
+				got[ip.String()] = alloc.ContainerID
+				if alloc.ContainerID == RecoveredContainerID && alloc.AllocatedAt.IsZero() {
+					t.Errorf("recovered allocation of %s has no AllocatedAt", ip)
+				}
+				return true
+			})
+			if len(got) != len(tt.want) {
+				t.Errorf("allocations = %v, want %v", got, tt.want)
+			}
+			for ip, id := range tt.want {
+				if got[ip] != id {
+					t.Errorf("allocation of %s = %q, want %q", ip, got[ip], id)
+				}
+			}
+		})
+	}
+}
+
+// TestLoadDataRecoverFuncError RecoverFunc 失败时 LoadData 返回错误，而不是丢掉备份之后的分配
+func TestLoadDataRecoverFuncError(t *testing.T) {
+	s := newTestStore(t)
+	corruptFile(t, s.dataFile)
+
+	errLive := errors.New("no netns")
+	if _, err := reopen(t, s, func() ([]net.IP, error) { return nil, errLive }); err == nil {
+		t.Error("LoadData() succeeded, want error")
+	}
+}
+
+// TestSaveRemovesTmp Save 失败时不留下临时文件，数据文件保持原来的内容
+func TestSaveRemovesTmp(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, s *Store)
+	}{
+		{
+			// 写入临时文件时磁盘已满
+			name: "write",
+			setup: func(t *testing.T, s *Store) {
+				if _, err := os.Stat("/dev/full"); err != nil {
+					t.Skip("/dev/full is not available")
+				}
+				if err := os.Symlink("/dev/full", s.dataFile+".tmp"); err != nil {
+					t.Fatalf("Symlink: %v", err)
+				}
+			},
+		},
+		{
+			// 旧的备份无法删除
+			name: "backup",
+			setup: func(t *testing.T, s *Store) {
+				if err := os.Remove(s.backupFile()); err != nil {
+					t.Fatalf("Remove: %v", err)
+				}
+				if err := os.MkdirAll(filepath.Join(s.backupFile(), "x"), 0700); err != nil {
+					t.Fatalf("MkdirAll: %v", err)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestStore(t)
+			tt.setup(t, s)
+
+			if err := s.Add(testIP3, Allocation{ContainerID: "c3", IfName: "eth0"}); err == nil {
+				t.Fatal("Add() succeeded, want error")
+			}
+			if _, err := os.Lstat(s.dataFile + ".tmp"); !os.IsNotExist(err) {
+				t.Errorf("temp file is left behind: %v", err)
+			}
+
+			s2, err := reopen(t, s, nil)
+			if err != nil {
+				t.Fatalf("LoadData: %v", err)
+			}
+			if !s2.Contain(testIP2) || s2.Contain(testIP3) {
+				t.Errorf("data file changed after a failed save")
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+	"path"
+	"time"
+)
+
+// 历史记录中的事件类型
+const (
+	EventAllocate = "allocate"
+	EventRelease  = "release"
+)
+
+// DefaultHistorySize 是单个历史记录文件的大小上限，超过后轮转为 <network>.history.1
+const DefaultHistorySize = 1 << 20
+
+// Event 是历史记录中的一条事件，记录某个 IP 在某个时间被分配给谁或从谁那里释放
+type Event struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+	IP    string    `json:"ip"`
+	Allocation
+}
+
+// journal 是保存在数据文件旁边、只追加的历史记录，用于排查 IP 冲突时查看一个 IP 之前被谁使用过
+//
+// 每行一个 JSON 格式的 Event。文件超过 maxSize 后轮转，只保留上一个文件，因此总大小不超过 2*maxSize。
+// 调用方已经持有 store 的锁，这里不需要再加锁
+type journal struct {
+	file    string
+	maxSize int64
+}
+
+func newJournal(dir, networkName string) *journal {
+	return &journal{file: path.Join(dir, networkName+".history"), maxSize: DefaultHistorySize}
+}
+
+// HistoryFile 返回 network 的历史记录文件路径
+func HistoryFile(dataDir, networkName string) (string, error) {
+	dir, err := NetworkDir(dataDir, networkName)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(dir, networkName+".history"), nil
+}
+
+// record 追加一条事件，j 为 nil 时什么也不做
+//
+// 历史记录只用于排查问题，写入失败只打印日志，不影响 IP 的分配与释放
+func (j *journal) record(event string, ip net.IP, alloc Allocation) {
+	if j == nil {
+		return
+	}
+
+	raw, err := json.Marshal(Event{Time: time.Now().UTC(), Event: event, IP: ip.String(), Allocation: alloc})
+	if err != nil {
+		log.Printf("WARNING: failed to encode history event: %v", err)
+		return
+	}
+
+	if err := j.rotate(); err != nil {
+		log.Printf("WARNING: failed to rotate history %s: %v", j.file, err)
+	}
+
+	f, err := os.OpenFile(j.file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		log.Printf("WARNING: failed to open history %s: %v", j.file, err)
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(raw, '\n')); err != nil {
+		log.Printf("WARNING: failed to write history %s: %v", j.file, err)
+	}
+}
+
+// rotate 在文件超过大小上限时把它重命名为 <file>.1，覆盖更早的记录
+func (j *journal) rotate() error {
+	info, err := os.Stat(j.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Size() < j.maxSize {
+		return nil
+	}
+	return os.Rename(j.file, j.file+".1")
+}
+
+// ReadHistory 按时间顺序读取历史记录文件（包括轮转出去的上一个文件）中的事件，文件不存在时返回空
+func ReadHistory(file string) ([]Event, error) {
+	var events []Event
+	for _, name := range []string{file + ".1", file} {
+		f, err := os.Open(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var e Event
+			// 宕机时可能留下写了一半的最后一行，跳过即可
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				continue
+			}
+			events = append(events, e)
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return events, nil
+}
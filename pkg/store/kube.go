@@ -0,0 +1,422 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/alexflint/go-filemutex"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	ctrlconfig "sigs.k8s.io/controller-runtime/pkg/client/config"
+)
+
+const (
+	// 记录在 IPAllocation 上的标签，用于按网络与节点筛选
+	LabelNetwork = "simplecni.kerolt.io/network"
+	LabelNode    = "simplecni.kerolt.io/node"
+
+	// DefaultKubeNamespace 不属于任何 Pod 的记录（保留、冷却中或无法识别 Pod 的分配）所在的命名空间
+	DefaultKubeNamespace = "kube-system"
+
+	kubeTimeout = 10 * time.Second
+)
+
+var (
+	// IPAllocationGVK 是 deploy/crd.yml 中定义的 IPAllocation 资源
+	IPAllocationGVK = schema.GroupVersionKind{Group: "simplecni.kerolt.io", Version: "v1alpha1", Kind: "IPAllocation"}
+
+	// ErrConflict 表示 API Server 上的记录已被其他进程修改，调用方可以重试
+	ErrConflict = errors.New("store conflict")
+)
+
+// PodRef 标识一个 Pod，IPAllocation 会以该 Pod 为 owner，Pod 删除后由 Kubernetes 回收
+type PodRef struct {
+	Namespace string
+	Name      string
+	UID       string
+}
+
+// IPAllocationSpec 是 IPAllocation 资源的 spec，一个对象对应节点上的一个 IP
+type IPAllocationSpec struct {
+	Network     string `json:"network"`
+	Node        string `json:"node"`
+	IP          string `json:"ip"`
+	ContainerID string `json:"containerID,omitempty"`
+	IfName      string `json:"ifName,omitempty"`
+	Pod         string `json:"pod,omitempty"`         // 使用该 IP 的 Pod，格式为 <namespace>/<name>
+	PodUID      string `json:"podUID,omitempty"`      // 使用该 IP 的 Pod 的 UID
+	Netns       string `json:"netns,omitempty"`       // 容器网络命名空间的路径
+	AllocatedAt string `json:"allocatedAt,omitempty"` // RFC3339 格式的分配时间
+
+	ReservedFor    string `json:"reservedFor,omitempty"`    // 固定 IP 模式下保留给的 Pod
+	ReservedIfName string `json:"reservedIfName,omitempty"` // 固定 IP 模式下保留给的 Pod 接口
+	ReservedUntil  string `json:"reservedUntil,omitempty"`  // RFC3339 格式的保留截止时间
+	ReleasedAt     string `json:"releasedAt,omitempty"`     // RFC3339 格式的最近一次释放时间
+}
+
+// Allocated 判断该 IP 当前是否分配给了容器
+func (spec *IPAllocationSpec) Allocated() bool {
+	return spec.ContainerID != ""
+}
+
+// allocation 将 spec 中的分配信息转换为 Allocation
+func (spec *IPAllocationSpec) allocation() Allocation {
+	alloc := Allocation{
+		ContainerID: spec.ContainerID,
+		IfName:      spec.IfName,
+		PodUID:      spec.PodUID,
+		Netns:       spec.Netns,
+		AllocatedAt: parseTime(spec.AllocatedAt),
+	}
+	alloc.PodNamespace, alloc.PodName, _ = SplitPodKey(spec.Pod)
+	return alloc
+}
+
+// ParseIPAllocation 从 unstructured 对象中解析 IPAllocation 的 spec
+func ParseIPAllocation(obj *unstructured.Unstructured) (*IPAllocationSpec, error) {
+	raw, ok := obj.Object["spec"].(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("IPAllocation %s/%s has no spec", obj.GetNamespace(), obj.GetName())
+	}
+
+	spec := &IPAllocationSpec{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(raw, spec); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+// NewKubeClient 根据 kubeconfig 创建 Kubernetes 客户端，kubeconfig 为空时使用 KUBECONFIG 环境变量或集群内配置
+func NewKubeClient(kubeconfig string) (client.Client, error) {
+	var cfg *rest.Config
+	var err error
+	if kubeconfig != "" {
+		cfg, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+	} else {
+		cfg, err = ctrlconfig.GetConfig()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return client.New(cfg, client.Options{})
+}
+
+// KubeStore 是基于 Kubernetes 自定义资源 IPAllocation 的 Backend 实现
+//
+// 每个 IP 对应一个 IPAllocation 对象，分配给 Pod 时对象位于 Pod 所在的命名空间并以 Pod 为 owner，
+// 因此整个集群的 IP 使用情况都可以通过 kubectl get ipallocations -A 查看，节点磁盘丢失也不影响分配记录。
+//
+// 同一节点上的并发通过本地文件锁串行化，与 API Server 上其他写入者（如 cnid 的回收）的冲突则依赖
+// resourceVersion 的乐观并发控制，发生冲突时返回 ErrConflict
+type KubeStore struct {
+	*filemutex.FileMutex
+	state
+	client  client.Client
+	network string
+	node    string
+	owner   *PodRef
+	objects map[string]*unstructured.Unstructured // key 是 IP 地址，上一次从 API Server 读取到的对象
+	saved   *data
+	history *journal
+}
+
+func NewKubeStore(storeDir, networkName, kubeconfig, node string, owner *PodRef) (*KubeStore, error) {
+	if node == "" {
+		return nil, fmt.Errorf("node name is required by the crd store")
+	}
+
+	dir, err := ensureDir(storeDir, networkName)
+	if err != nil {
+		return nil, err
+	}
+	fl, err := newFileLock(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := NewKubeClient(kubeconfig)
+	if err != nil {
+		fl.Close()
+		return nil, err
+	}
+
+	return &KubeStore{
+		FileMutex: fl,
+		state:     state{data: newData()},
+		client:    c,
+		network:   networkName,
+		node:      node,
+		owner:     owner,
+		objects:   make(map[string]*unstructured.Unstructured),
+		saved:     newData(),
+		history:   newJournal(dir, networkName),
+	}, nil
+}
+
+// LoadData 从 API Server 读取本节点、本网络的所有 IPAllocation
+func (s *KubeStore) LoadData() error {
+	ctx, cancel := context.WithTimeout(context.Background(), kubeTimeout)
+	defer cancel()
+
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(IPAllocationGVK.GroupVersion().WithKind(IPAllocationGVK.Kind + "List"))
+	if err := s.client.List(ctx, list, client.MatchingLabels{LabelNetwork: s.network, LabelNode: s.node}); err != nil {
+		return err
+	}
+
+	data := newData()
+	objects := make(map[string]*unstructured.Unstructured)
+	var lastAt time.Time
+	for i := range list.Items {
+		obj := &list.Items[i]
+		spec, err := ParseIPAllocation(obj)
+		if err != nil {
+			return err
+		}
+		if prev, ok := objects[spec.IP]; ok {
+			log.Printf("WARNING: duplicate IPAllocation for %s: %s/%s and %s/%s", spec.IP, prev.GetNamespace(), prev.GetName(), obj.GetNamespace(), obj.GetName())
+			continue
+		}
+		objects[spec.IP] = obj
+
+		if spec.Allocated() {
+			data.IPs[spec.IP] = spec.allocation()
+			if at := parseTime(spec.AllocatedAt); at.After(lastAt) {
+				lastAt, data.Last = at, spec.IP
+			}
+		}
+		if spec.ReservedFor != "" {
+			data.Reserved[spec.IP] = reservation{Pod: spec.ReservedFor, IfName: spec.ReservedIfName, Expires: parseTime(spec.ReservedUntil)}
+		}
+		if spec.ReleasedAt != "" {
+			data.Released[spec.IP] = parseTime(spec.ReleasedAt)
+		}
+	}
+
+	s.data = data
+	s.saved = cloneData(data)
+	s.objects = objects
+	return nil
+}
+
+// save 把与上一次同步相比发生变化的 IP 写回 API Server
+func (s *KubeStore) save() error {
+	ctx, cancel := context.WithTimeout(context.Background(), kubeTimeout)
+	defer cancel()
+
+	changed := make(map[string]bool)
+	diffKeys(changed, s.saved.IPs, s.data.IPs)
+	diffKeys(changed, s.saved.Reserved, s.data.Reserved)
+	diffKeys(changed, s.saved.Released, s.data.Released)
+
+	for ip := range changed {
+		if err := s.sync(ctx, ip); err != nil {
+			if apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err) {
+				return fmt.Errorf("%w: IPAllocation for %s: %v", ErrConflict, ip, err)
+			}
+			return err
+		}
+	}
+
+	s.saved = cloneData(s.data)
+	return nil
+}
+
+// sync 让 API Server 上 ip 对应的对象与内存中的数据保持一致
+func (s *KubeStore) sync(ctx context.Context, ip string) error {
+	spec, ok := s.desired(ip)
+	obj := s.objects[ip]
+
+	if !ok {
+		if obj == nil {
+			return nil
+		}
+		rv := obj.GetResourceVersion()
+		err := s.client.Delete(ctx, obj, client.Preconditions{ResourceVersion: &rv})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		delete(s.objects, ip)
+		return nil
+	}
+
+	namespace := DefaultKubeNamespace
+	var owners []metav1.OwnerReference
+	if spec.Allocated() && s.owner != nil && spec.Pod == s.owner.Namespace+"/"+s.owner.Name {
+		namespace = s.owner.Namespace
+		if s.owner.UID != "" {
+			owners = []metav1.OwnerReference{{
+				APIVersion: "v1",
+				Kind:       "Pod",
+				Name:       s.owner.Name,
+				UID:        types.UID(s.owner.UID),
+			}}
+		}
+	} else if obj != nil {
+		namespace = obj.GetNamespace()
+	}
+
+	raw, err := runtime.DefaultUnstructuredConverter.ToUnstructured(spec)
+	if err != nil {
+		return err
+	}
+
+	// 命名空间发生变化时只能删除后重建
+	if obj != nil && obj.GetNamespace() != namespace {
+		rv := obj.GetResourceVersion()
+		if err := s.client.Delete(ctx, obj, client.Preconditions{ResourceVersion: &rv}); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		delete(s.objects, ip)
+		obj = nil
+	}
+
+	if obj == nil {
+		obj = &unstructured.Unstructured{}
+		obj.SetGroupVersionKind(IPAllocationGVK)
+		obj.SetNamespace(namespace)
+		obj.SetName(IPAllocationName(s.network, s.node, ip))
+		obj.SetLabels(map[string]string{LabelNetwork: s.network, LabelNode: s.node})
+		obj.SetOwnerReferences(owners)
+		obj.Object["spec"] = raw
+		if err := s.client.Create(ctx, obj); err != nil {
+			return err
+		}
+		s.objects[ip] = obj
+		return nil
+	}
+
+	// Update 会带上读取时的 resourceVersion，期间对象被修改过则返回 Conflict
+	obj = obj.DeepCopy()
+	if spec.Allocated() {
+		obj.SetOwnerReferences(owners)
+	} else {
+		// 不再被 Pod 使用的记录（保留或冷却中）不能随 Pod 一起被回收
+		obj.SetOwnerReferences(nil)
+	}
+	obj.Object["spec"] = raw
+	if err := s.client.Update(ctx, obj); err != nil {
+		return err
+	}
+	s.objects[ip] = obj
+	return nil
+}
+
+// desired 根据内存中的数据计算 ip 对应的 spec，ip 没有任何记录时返回 false
+func (s *KubeStore) desired(ip string) (*IPAllocationSpec, bool) {
+	alloc, allocated := s.data.IPs[ip]
+	r, reserved := s.data.Reserved[ip]
+	releasedAt, released := s.data.Released[ip]
+	if !allocated && !reserved && !released {
+		return nil, false
+	}
+
+	spec := &IPAllocationSpec{Network: s.network, Node: s.node, IP: ip}
+	if allocated {
+		spec.ContainerID = alloc.ContainerID
+		spec.IfName = alloc.IfName
+		spec.Pod = alloc.Pod()
+		spec.PodUID = alloc.PodUID
+		spec.Netns = alloc.Netns
+		spec.AllocatedAt = alloc.AllocatedAt.UTC().Format(time.RFC3339)
+	}
+	if reserved {
+		spec.ReservedFor = r.Pod
+		spec.ReservedIfName = r.IfName
+		spec.ReservedUntil = r.Expires.UTC().Format(time.RFC3339)
+	}
+	if released {
+		spec.ReleasedAt = releasedAt.UTC().Format(time.RFC3339)
+	}
+	return spec, true
+}
+
+// Add 添加一个新的 IP 分配记录，并写入历史记录
+func (s *KubeStore) Add(ip net.IP, alloc Allocation) error {
+	if err := s.data.add(ip, alloc); err != nil {
+		return err
+	}
+	if err := s.save(); err != nil {
+		return err
+	}
+	s.history.record(EventAllocate, ip, s.data.IPs[ip.String()])
+	return nil
+}
+
+// Del 删除容器 id 的 ifName 接口的 IP 分配记录，返回被删除的 IP
+func (s *KubeStore) Del(id, ifName string) (net.IP, error) {
+	ip, alloc := s.data.del(id, ifName)
+	if ip == nil {
+		return nil, nil
+	}
+	if err := s.save(); err != nil {
+		return nil, err
+	}
+	s.history.record(EventRelease, ip, alloc)
+	return ip, nil
+}
+
+// DelIP 删除 ip 的分配记录，返回记录是否存在
+func (s *KubeStore) DelIP(ip net.IP) (bool, error) {
+	alloc, ok := s.data.delIP(ip)
+	if !ok {
+		return false, nil
+	}
+	if err := s.save(); err != nil {
+		return false, err
+	}
+	s.history.record(EventRelease, ip, alloc)
+	return true, nil
+}
+
+// restore 用 d 整体替换数据并同步到 API Server，用于导入
+func (s *KubeStore) restore(d *data) error {
+	s.data = d
+	return s.save()
+}
+
+// Reserve 在 expires 之前为 Pod 保留 IP
+func (s *KubeStore) Reserve(ip net.IP, pod, ifName string, expires time.Time) error {
+	if err := s.data.reserve(ip, pod, ifName, expires); err != nil {
+		return err
+	}
+	return s.save()
+}
+
+// IPAllocationName 返回 node 上 ip 对应的 IPAllocation 对象名称，如 simple-cni-node1-10-244-1-5
+//
+// 名称中包含节点：子网重新分配后，不同节点的同一个 IP 可能同时存在，只按网络与 IP 命名会在同一个命名空间中冲突
+func IPAllocationName(network, node, ip string) string {
+	return strings.ToLower(network + "-" + node + "-" + strings.NewReplacer(".", "-", ":", "-").Replace(ip))
+}
+
+func parseTime(s string) time.Time {
+	t, _ := time.Parse(time.RFC3339, s)
+	return t
+}
+
+// diffKeys 把 old 与 cur 之间新增、删除或变化的 key 记录到 out 中
+func diffKeys[T comparable](out map[string]bool, old, cur map[string]T) {
+	for k, v := range old {
+		if c, ok := cur[k]; !ok || c != v {
+			out[k] = true
+		}
+	}
+	for k := range cur {
+		if _, ok := old[k]; !ok {
+			out[k] = true
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package store
+
+import (
+	"testing"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newTestKubeStore(t *testing.T, c client.Client, node string) *KubeStore {
+	t.Helper()
+	dir, err := ensureDir(t.TempDir(), testNetwork)
+	if err != nil {
+		t.Fatalf("ensureDir: %v", err)
+	}
+	return &KubeStore{
+		state:   state{data: newData()},
+		client:  c,
+		network: testNetwork,
+		node:    node,
+		saved:   newData(),
+		history: newJournal(dir, testNetwork),
+	}
+}
+
+// TestKubeStoreSameIPOnTwoNodes 子网重新分配后两个节点上的同一个 IP 各自对应一个 IPAllocation，互不冲突
+func TestKubeStoreSameIPOnTwoNodes(t *testing.T) {
+	c := fake.NewClientBuilder().Build()
+	stores := []*KubeStore{newTestKubeStore(t, c, "node1"), newTestKubeStore(t, c, "node2")}
+
+	for i, s := range stores {
+		if err := s.LoadData(); err != nil {
+			t.Fatalf("LoadData: %v", err)
+		}
+		if err := s.Add(testIP1, Allocation{ContainerID: "c" + s.node, IfName: "eth0"}); err != nil {
+			t.Fatalf("Add on store %d: %v", i, err)
+		}
+	}
+
+	for _, s := range stores {
+		if err := s.LoadData(); err != nil {
+			t.Fatalf("LoadData: %v", err)
+		}
+		got := owners(s.snapshot())
+		if len(got) != 1 || got[testIP1.String()] != "c"+s.node+"/eth0" {
+			t.Errorf("allocations on %s = %v, want only its own", s.node, got)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package store
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// MemoryStore 是只保存在内存中的 Backend 实现，进程退出后数据即丢失，主要用于测试
+type MemoryStore struct {
+	mu sync.Mutex
+	state
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{state: state{data: newData()}}
+}
+
+func (s *MemoryStore) Lock() error {
+	s.mu.Lock()
+	return nil
+}
+
+func (s *MemoryStore) Unlock() error {
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// LoadData 数据始终在内存中，无需读取
+func (s *MemoryStore) LoadData() error {
+	return nil
+}
+
+// Add 添加一个新的 IP 分配记录
+func (s *MemoryStore) Add(ip net.IP, alloc Allocation) error {
+	return s.data.add(ip, alloc)
+}
+
+// Del 删除容器 id 的 ifName 接口的 IP 分配记录，返回被删除的 IP
+func (s *MemoryStore) Del(id, ifName string) (net.IP, error) {
+	ip, _ := s.data.del(id, ifName)
+	return ip, nil
+}
+
+// DelIP 删除 ip 的分配记录，返回记录是否存在
+func (s *MemoryStore) DelIP(ip net.IP) (bool, error) {
+	_, ok := s.data.delIP(ip)
+	return ok, nil
+}
+
+// restore 用 d 整体替换数据，用于导入
+func (s *MemoryStore) restore(d *data) error {
+	s.data = d
+	return nil
+}
+
+// Reserve 在 expires 之前为 Pod 的 ifName 接口保留 IP
+func (s *MemoryStore) Reserve(ip net.IP, pod, ifName string, expires time.Time) error {
+	return s.data.reserve(ip, pod, ifName, expires)
+}
@@ -0,0 +1,70 @@
+package store
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// LegacyStoreDir 是早期版本在网络配置没有设置 dataDir 时使用的数据目录，
+// 仍然存在的旧数据会继续在这里使用，避免升级后丢失分配记录
+const LegacyStoreDir = "/var/lib/simple-cni"
+
+// networkNameRe 与 libcni 对网络名称的要求一致，保证名称可以安全地用作目录与文件名
+var networkNameRe = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.\-]*$`)
+
+// ValidateNetworkName 校验网络名称，名称会作为数据目录与文件名的一部分
+func ValidateNetworkName(name string) error {
+	if !networkNameRe.MatchString(name) {
+		return fmt.Errorf("invalid network name %q: must match %s", name, networkNameRe)
+	}
+	return nil
+}
+
+// NetworkDir 返回 network 的数据目录 <dataDir>/<network>，不会创建目录
+//
+// 每个网络的数据（数据文件、备份、锁、历史记录）都在各自的目录中，同一节点上的多个网络互不影响。
+// dataDir 为空时使用 DefaultStoreDir，只有旧目录 LegacyStoreDir/<network> 存在时才继续使用旧目录
+func NetworkDir(dataDir, network string) (string, error) {
+	if err := ValidateNetworkName(network); err != nil {
+		return "", err
+	}
+
+	if dataDir != "" {
+		if !filepath.IsAbs(dataDir) {
+			return "", fmt.Errorf("dataDir %q must be an absolute path", dataDir)
+		}
+		return filepath.Join(filepath.Clean(dataDir), network), nil
+	}
+
+	dir := filepath.Join(DefaultStoreDir, network)
+	legacy := filepath.Join(LegacyStoreDir, network)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if _, err := os.Stat(legacy); err == nil {
+			log.Printf("WARNING: using legacy store directory %s, move it to %s or set dataDir", legacy, dir)
+			return legacy, nil
+		}
+	}
+	return dir, nil
+}
+
+// ensureDir 确保 network 的数据目录存在并返回其路径
+//
+// 父目录不存在时一并创建。分配记录中包含 Pod 与 netns 信息，数据目录只允许 root 访问
+func ensureDir(dataDir, network string) (string, error) {
+	dir, err := NetworkDir(dataDir, network)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	// 早期版本以 0755 创建目录，这里统一收紧权限
+	if err := os.Chmod(dir, 0700); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
@@ -0,0 +1,107 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// SchemaVersion 是当前数据格式的版本号，修改 data 的持久化格式时需要递增它并在 migrations 中追加迁移函数
+//
+//	0：最初的格式 {"ips": ..., "last": ...}，没有 version 字段
+//	1：增加 version、reserved（固定 IP 保留）与 released（释放时间）
+//	2：分配以 (container_id, if_name) 为标识，reserved 记录增加 if_name
+//	3：分配记录增加 Pod、netns 与分配时间
+const SchemaVersion = 3
+
+// migration 把上一个版本的文档原地升级到下一个版本
+type migration func(doc map[string]any) error
+
+// migrations[i] 负责把版本 i 升级到版本 i+1
+var migrations = []migration{
+	migrateV0ToV1,
+	migrateV1ToV2,
+	migrateV2ToV3,
+}
+
+// migrateV0ToV1 补全 reserved、released 字段
+func migrateV0ToV1(doc map[string]any) error {
+	if _, ok := doc["ips"]; !ok {
+		doc["ips"] = map[string]any{}
+	}
+	for _, key := range []string{"reserved", "released"} {
+		if _, ok := doc[key]; !ok {
+			doc[key] = map[string]any{}
+		}
+	}
+	return nil
+}
+
+// migrateV1ToV2 版本 1 的保留记录没有 if_name，保持为空表示可以用于 Pod 的任意接口
+func migrateV1ToV2(doc map[string]any) error {
+	return nil
+}
+
+// migrateV2ToV3 新增的字段都是可选的，旧记录保持为空
+func migrateV2ToV3(doc map[string]any) error {
+	return nil
+}
+
+// ErrSchemaTooNew 表示数据由更新版本的插件写入，当前版本无法安全地读取和改写
+type ErrSchemaTooNew struct {
+	Version int
+}
+
+func (e *ErrSchemaTooNew) Error() string {
+	return fmt.Sprintf("store schema version %d is newer than supported version %d, refusing to downgrade", e.Version, SchemaVersion)
+}
+
+// checkVersion 校验版本号，拒绝比当前版本更新的数据
+func checkVersion(version int) error {
+	if version > SchemaVersion {
+		return &ErrSchemaTooNew{Version: version}
+	}
+	if version < 0 {
+		return fmt.Errorf("invalid store schema version %d", version)
+	}
+	return nil
+}
+
+// decodeData 解析 JSON 文档，必要时依次执行迁移函数升级到 SchemaVersion
+//
+// 返回的 from 是文档原来的版本，from < SchemaVersion 时调用方需要把升级后的数据写回
+func decodeData(raw []byte) (d *data, from int, err error) {
+	doc := make(map[string]any)
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, 0, err
+	}
+
+	if v, ok := doc["version"]; ok {
+		f, ok := v.(float64)
+		if !ok || f != float64(int(f)) {
+			return nil, 0, fmt.Errorf("invalid store schema version %v", v)
+		}
+		from = int(f)
+	}
+	if err := checkVersion(from); err != nil {
+		return nil, from, err
+	}
+
+	for v := from; v < SchemaVersion; v++ {
+		if err := migrations[v](doc); err != nil {
+			return nil, from, fmt.Errorf("failed to migrate store from version %d to %d: %v", v, v+1, err)
+		}
+		doc["version"] = v + 1
+	}
+
+	raw, err = json.Marshal(doc)
+	if err != nil {
+		return nil, from, err
+	}
+
+	d = newData()
+	if err := json.Unmarshal(raw, d); err != nil {
+		return nil, from, err
+	}
+	d.init()
+	return d, from, nil
+}
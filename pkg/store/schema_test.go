@@ -0,0 +1,164 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// 各个版本的插件实际写入的数据文件
+const (
+	fixtureV0 = `{"ips":{"10.244.1.2":{"container_id":"c1","if_name":"eth0"}},"last":"10.244.1.2"}`
+
+	fixtureV1 = `{"version":1,"ips":{"10.244.1.2":{"container_id":"c1","if_name":"eth0"}},"last":"10.244.1.3",
+		"reserved":{"10.244.1.3":{"pod":"default/web-0","expires":"2030-01-01T00:00:00Z"}},
+		"released":{"10.244.1.3":"2026-01-01T00:00:00Z"}}`
+
+	fixtureV2 = `{"version":2,"ips":{"10.244.1.2":{"container_id":"c1","if_name":"eth0"},"10.244.1.4":{"container_id":"c1","if_name":"net1"}},
+		"last":"10.244.1.4","reserved":{"10.244.1.3":{"pod":"default/web-0","if_name":"eth0","expires":"2030-01-01T00:00:00Z"}}}`
+)
+
+// TestDecodeDataMigrate 旧版本的数据升级到 SchemaVersion 后内容保持不变，缺失的字段被补全
+func TestDecodeDataMigrate(t *testing.T) {
+	expires := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	released := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		raw      string
+		wantFrom int
+		want     *data
+	}{
+		{
+			name:     "v0",
+			raw:      fixtureV0,
+			wantFrom: 0,
+			want: &data{
+				Version:  SchemaVersion,
+				IPs:      map[string]Allocation{"10.244.1.2": {ContainerID: "c1", IfName: "eth0"}},
+				Last:     "10.244.1.2",
+				Reserved: map[string]reservation{},
+				Released: map[string]time.Time{},
+			},
+		},
+		{
+			name:     "v0 without ips",
+			raw:      `{"last":""}`,
+			wantFrom: 0,
+			want:     newData(),
+		},
+		{
+			name:     "v1",
+			raw:      fixtureV1,
+			wantFrom: 1,
+			want: &data{
+				Version:  SchemaVersion,
+				IPs:      map[string]Allocation{"10.244.1.2": {ContainerID: "c1", IfName: "eth0"}},
+				Last:     "10.244.1.3",
+				Reserved: map[string]reservation{"10.244.1.3": {Pod: "default/web-0", Expires: expires}},
+				Released: map[string]time.Time{"10.244.1.3": released},
+			},
+		},
+		{
+			name:     "v2",
+			raw:      fixtureV2,
+			wantFrom: 2,
+			want: &data{
+				Version: SchemaVersion,
+				IPs: map[string]Allocation{
+					"10.244.1.2": {ContainerID: "c1", IfName: "eth0"},
+					"10.244.1.4": {ContainerID: "c1", IfName: "net1"},
+				},
+				Last:     "10.244.1.4",
+				Reserved: map[string]reservation{"10.244.1.3": {Pod: "default/web-0", IfName: "eth0", Expires: expires}},
+				Released: map[string]time.Time{},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, from, err := decodeData([]byte(tt.raw))
+			if err != nil {
+				t.Fatalf("decodeData: %v", err)
+			}
+			if from != tt.wantFrom {
+				t.Errorf("from = %d, want %d", from, tt.wantFrom)
+			}
+			if !reflect.DeepEqual(d, tt.want) {
+				t.Errorf("decodeData() = %+v, want %+v", d, tt.want)
+			}
+		})
+	}
+}
+
+// TestDecodeDataInvalidVersion 拒绝更新版本写入的数据与无效的版本号
+func TestDecodeDataInvalidVersion(t *testing.T) {
+	tests := []struct {
+		name   string
+		raw    string
+		tooNew bool
+	}{
+		{name: "newer", raw: `{"version":4,"ips":{}}`, tooNew: true},
+		{name: "much newer", raw: `{"version":100,"ips":{},"pools":[]}`, tooNew: true},
+		{name: "negative", raw: `{"version":-1,"ips":{}}`},
+		{name: "fraction", raw: `{"version":1.5,"ips":{}}`},
+		{name: "string", raw: `{"version":"3","ips":{}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, _, err := decodeData([]byte(tt.raw))
+			if err == nil {
+				t.Fatalf("decodeData() = %+v, want error", d)
+			}
+			var tooNew *ErrSchemaTooNew
+			if got := errors.As(err, &tooNew); got != tt.tooNew {
+				t.Errorf("decodeData() error = %v, ErrSchemaTooNew %v, want %v", err, got, tt.tooNew)
+			}
+		})
+	}
+}
+
+// TestLoadDataMigrate 旧版本的数据文件在加载时原地升级，升级前的内容保留为备份
+func TestLoadDataMigrate(t *testing.T) {
+	s, err := NewStore(t.TempDir(), testNetwork)
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	if err := os.WriteFile(s.dataFile, []byte(fixtureV0), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	if err := s.LoadData(); err != nil {
+		t.Fatalf("LoadData: %v", err)
+	}
+	if from, err := s.Verify(); err != nil || from != SchemaVersion {
+		t.Errorf("data file version = %d, %v, want %d", from, err, SchemaVersion)
+	}
+	if raw, err := os.ReadFile(s.backupFile()); err != nil || string(raw) != fixtureV0 {
+		t.Errorf("backup = %q, %v, want the original file", raw, err)
+	}
+}
+
+// TestLoadDataTooNew 更新版本写入的数据文件不会被当作损坏而改写
+func TestLoadDataTooNew(t *testing.T) {
+	s, err := NewStore(t.TempDir(), testNetwork)
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	raw := []byte(`{"version":4,"ips":{"10.244.1.2":{"container_id":"c1","if_name":"eth0"}}}`)
+	if err := os.WriteFile(s.dataFile, raw, 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	var tooNew *ErrSchemaTooNew
+	if err := s.LoadData(); !errors.As(err, &tooNew) {
+		t.Fatalf("LoadData() = %v, want ErrSchemaTooNew", err)
+	}
+	if got, err := os.ReadFile(s.dataFile); err != nil || string(got) != string(raw) {
+		t.Errorf("data file = %q, %v, want it untouched", got, err)
+	}
+}
@@ -1,130 +1,261 @@
 // 持久化并协调管理 CNI 插件分配的网络信息（主要是 IP 和对应的容器/接口信息）
 //
 // 为什么需要 store
-//  1. 防止 IP 冲突与丢失状态：CNI 插件在给容器分配 IP 时需要记录哪些 IP 已被分配、分配给哪个容器。如果只保存在内存，进程重启或机器重启后会丢失分配状态，可能导致重复分配同一 IP。store 把这些信息写到磁盘（/var/lib/cni/<network>.json）以便恢复。
+//  1. 防止 IP 冲突与丢失状态：CNI 插件在给容器分配 IP 时需要记录哪些 IP 已被分配、分配给哪个容器。如果只保存在内存，进程重启或机器重启后会丢失分配状态，可能导致重复分配同一 IP。store 把这些信息写到磁盘（<dataDir>/<network>/<network>.json）以便恢复。
 //  2. 多进程/并发协调：在同一主机上可能有多个 CNI 操作同时进行，文件锁（go-filemutex）用于在修改这个数据文件时做同步，避免并发写入造成的数据损坏或竞争。
-//  3. 实现基本的 IPAM 操作：store 提供读取（LoadData）、查询（Contain、GetIPByID、Last）、修改（Add、Del）和持久化（Store）等 API，便于上层插件逻辑实现分配、释放和恢复流程。
+//  3. 实现基本的 IPAM 操作：store 提供读取（LoadData）、查询（Contain、GetIP、Last）、修改（Add、Del）和持久化（Store）等 API，便于上层插件逻辑实现分配、释放和恢复流程。
+//
+// 具体的存储方式由 Backend 的实现决定：JSON 文件（Store）、嵌入式 KV 数据库（BoltStore）、Kubernetes 自定义资源（KubeStore）
+// 以及仅用于测试的内存实现（MemoryStore）。
 package store
 
 import (
-	"encoding/json"
 	"fmt"
 	"net"
-	"os"
-	"path"
+	"strings"
+	"time"
+)
 
-	"github.com/alexflint/go-filemutex"
+const (
+	// DefaultStoreDir 是网络配置没有设置 dataDir 时使用的数据目录，与 host-local 等插件的惯例一致
+	DefaultStoreDir = "/var/lib/cni/networks"
 )
 
+// 网络配置中 store 字段可选的后端类型
 const (
-	DefaultStoreDir = "/var/lib/simple-cni"
+	BackendFile   = "file"
+	BackendBolt   = "bolt"
+	BackendMemory = "memory"
+	BackendCRD    = "crd"
 )
 
-// CNI 插件通常会被多个进程（不同容器的配置/解绑操作）并发调用，多个进程可能同时访问同一个 network 的 data 文件（network.json）。如果没有进程间锁，两个进程同时写入会产生竞态（race）或写入不完整/损坏的 JSON 文件。
-func newFileLock(lockPath string) (*filemutex.FileMutex, error) {
-	fileInfo, err := os.Stat(lockPath)
-	if err != nil {
-		return nil, err
-	}
+// Backend 是 IPAM 使用的存储接口
+//
+// 调用方需要先 Lock，再 LoadData 读取最新数据，之后才能查询与修改，最后 Unlock。修改类方法会立即持久化。
+type Backend interface {
+	Lock() error
+	Unlock() error
+	Close() error
 
-	if fileInfo.IsDir() {
-		lockPath = path.Join(lockPath, "lock")
-	}
+	// LoadData 从后端读取最新的数据
+	LoadData() error
 
-	fm, err := filemutex.New(lockPath)
-	if err != nil {
-		return nil, err
-	}
+	// 查询
+	GetIP(id, ifName string) (net.IP, bool)
+	Contain(ip net.IP) bool
+	Last() net.IP
+	GetReservedIP(pod, ifName string) (net.IP, bool)
+	ReservedBy(ip net.IP) (pod, ifName string, ok bool)
+	ReleasedAt(ip net.IP) (time.Time, bool)
+
+	// Iterate 按任意顺序遍历所有分配记录，fn 返回 false 时停止遍历
+	Iterate(fn func(ip net.IP, alloc Allocation) bool)
+
+	// 修改
+	Add(ip net.IP, alloc Allocation) error
+	Del(id, ifName string) (net.IP, error)
+	// DelIP 按 IP 删除分配记录，用于清理无法按容器区分的记录（如多条从网络接口恢复出来的记录），返回记录是否存在
+	DelIP(ip net.IP) (bool, error)
+	Reserve(ip net.IP, pod, ifName string, expires time.Time) error
+	PurgeReleased(before time.Time)
+}
 
-	return fm, nil
+// Recoverable 由能够在数据损坏时从现存网络接口重建数据的后端实现
+type Recoverable interface {
+	SetRecoverFunc(fn RecoverFunc)
 }
 
+// Options 创建 store 所需的参数
+type Options struct {
+	Kind    string // 后端类型，为空时使用 JSON 文件
+	Dir     string // 数据目录，必须是绝对路径，为空时使用 DefaultStoreDir，网络的数据保存在 <Dir>/<Network> 下
+	Network string // 网络名称，见 ValidateNetworkName
+
+	// 以下参数仅用于 crd 后端
+	Kubeconfig string  // kubeconfig 路径，为空时使用 KUBECONFIG 环境变量或集群内配置
+	Node       string  // 当前节点名称
+	Owner      *PodRef // 本次调用所属的 Pod
+}
+
+// New 根据后端类型创建 store
+func New(opts Options) (Backend, error) {
+	switch opts.Kind {
+	case "", BackendFile:
+		return NewStore(opts.Dir, opts.Network)
+	case BackendBolt:
+		return NewBoltStore(opts.Dir, opts.Network)
+	case BackendMemory:
+		return NewMemoryStore(), nil
+	case BackendCRD:
+		return NewKubeStore(opts.Dir, opts.Network, opts.Kubeconfig, opts.Node, opts.Owner)
+	default:
+		return nil, fmt.Errorf("unknown store backend %q", opts.Kind)
+	}
+}
+
+// Allocation 记录一个 IP 分配给了哪个容器的哪个接口，(ContainerID, IfName) 唯一标识一次分配
+//
 // IfName 是容器内的网络接口名称（network interface name），例如 "eth0"、"eth1" 或自定义名。
 //
 // CNI 插件用它来在容器的网络命名空间中定位并配置/解绑对应的接口（创建 veth pair 时作为容器端的接口名，或解绑时用来查找接口）。
 //
-// 与 ContainerID 不同，ContainerID 标识容器本身，IfName 标识容器里的某个网络接口
-type containerNetInfo struct {
-	ContainerID string `json:"container_id"`
-	IfName      string `json:"if_name"`
+// 与 ContainerID 不同，ContainerID 标识容器本身，IfName 标识容器里的某个网络接口。
+// 同一个容器在同一个网络上可以有多个接口，每个接口各自分配一个 IP
+//
+// 其余字段是排查 IP 冲突时使用的元数据，来自 CNI_ARGS 与 CNI_NETNS，旧版本的数据中为空
+type Allocation struct {
+	ContainerID  string    `json:"container_id"`
+	IfName       string    `json:"if_name"`
+	PodNamespace string    `json:"pod_namespace,omitempty"`
+	PodName      string    `json:"pod_name,omitempty"`
+	PodUID       string    `json:"pod_uid,omitempty"`
+	Netns        string    `json:"netns,omitempty"`       // 容器网络命名空间的路径
+	AllocatedAt  time.Time `json:"allocated_at,omitzero"` // 分配时间
 }
 
-type data struct {
-	IPs  map[string]containerNetInfo `json:"ips"`  // key 是 IP 地址，value 是对应的容器信息
-	Last string                      `json:"last"` // 最近分配的 IP 地址
+// SetPod 记录使用该 IP 的 Pod，pod 为 nil 时什么也不做
+func (a *Allocation) SetPod(pod *PodRef) {
+	if pod == nil {
+		return
+	}
+	a.PodNamespace, a.PodName, a.PodUID = pod.Namespace, pod.Name, pod.UID
+}
+
+// Pod 返回 "<namespace>/<name>" 形式的 Pod 标识，没有 Pod 信息时返回空字符串
+func (a Allocation) Pod() string {
+	if a.PodNamespace == "" || a.PodName == "" {
+		return ""
+	}
+	return a.PodNamespace + "/" + a.PodName
+}
+
+// SplitPodKey 将 <namespace>/<name> 拆分为命名空间与名称
+func SplitPodKey(key string) (string, string, bool) {
+	namespace, name, ok := strings.Cut(key, "/")
+	return namespace, name, ok && namespace != "" && name != ""
+}
+
+// Match 判断该分配记录是否属于容器 id 的 ifName 接口
+func (a Allocation) Match(id, ifName string) bool {
+	return a.ContainerID == id && a.IfName == ifName
+}
+
+// reservation 记录 DEL 之后仍为某个 Pod 保留的 IP（固定 IP 模式）
+type reservation struct {
+	Pod     string    `json:"pod"`               // Pod 标识，格式为 <namespace>/<name>
+	IfName  string    `json:"if_name,omitempty"` // Pod 内的接口名称，为空表示不限接口（旧版本数据）
+	Expires time.Time `json:"expires"`           // 保留的截止时间，过期后 IP 重新进入可分配池
 }
 
-type Store struct {
-	*filemutex.FileMutex
-	dir      string
-	data     *data
-	dataFile string
+// match 判断保留记录是否属于 pod 的 ifName 接口
+func (r reservation) match(pod, ifName string) bool {
+	return r.Pod == pod && (r.IfName == "" || r.IfName == ifName)
 }
 
-func NewStore(storeDir, networkName string) (*Store, error) {
-	if storeDir == "" {
-		storeDir = DefaultStoreDir
+type data struct {
+	Version  int                    `json:"version"`            // 数据格式版本，见 SchemaVersion
+	IPs      map[string]Allocation  `json:"ips"`                // key 是 IP 地址，value 是对应的容器信息
+	Last     string                 `json:"last"`               // 最近分配的 IP 地址
+	Reserved map[string]reservation `json:"reserved,omitempty"` // key 是 IP 地址，value 是为 Pod 保留的信息
+	Released map[string]time.Time   `json:"released,omitempty"` // key 是 IP 地址，value 是该 IP 最近一次被释放的时间
+}
+
+func newData() *data {
+	return &data{
+		Version:  SchemaVersion,
+		IPs:      make(map[string]Allocation),
+		Reserved: make(map[string]reservation),
+		Released: make(map[string]time.Time),
 	}
+}
 
-	dir := path.Join(storeDir, networkName)
-	if _, err := os.Stat(dir); os.IsNotExist(err) {
-		if err := os.Mkdir(dir, 0755); err != nil {
-			return nil, err
-		}
+// init 补全反序列化后可能为 nil 的 map
+func (d *data) init() {
+	if d.IPs == nil {
+		d.IPs = make(map[string]Allocation)
+	}
+	if d.Reserved == nil {
+		d.Reserved = make(map[string]reservation)
 	}
+	if d.Released == nil {
+		d.Released = make(map[string]time.Time)
+	}
+}
 
-	fl, err := newFileLock(dir)
-	if err != nil {
-		return nil, err
+// add 添加一个新的 IP 分配记录，alloc 没有分配时间时使用当前时间
+func (d *data) add(ip net.IP, alloc Allocation) error {
+	if len(ip) == 0 {
+		return fmt.Errorf("invalid IP")
 	}
 
-	dataFile := path.Join(dir, networkName+".json")
-	data := &data{
-		IPs: make(map[string]containerNetInfo),
+	if alloc.AllocatedAt.IsZero() {
+		alloc.AllocatedAt = time.Now().UTC()
 	}
+	d.IPs[ip.String()] = alloc
+	d.Last = ip.String()
 
-	return &Store{fl, dir, data, dataFile}, nil
+	// IP 重新被使用后不再需要保留，顺便清理过期的保留记录
+	delete(d.Reserved, ip.String())
+	delete(d.Released, ip.String())
+	d.purgeReservations(time.Now())
+	return nil
 }
 
-// LoadData 从 json 文件中读取数据到 s.data
-func (s *Store) LoadData() error {
-	data := &data{}
-	raw, err := os.ReadFile(s.dataFile)
-	if err != nil {
-		if os.IsNotExist(err) {
-			// 文件不存在则创建
-			file, err := os.Create(s.dataFile)
-			if err != nil {
-				return err
-			}
-			defer file.Close()
-
-			// 写入空的 JSON 对象
-			_, err = file.Write([]byte("{}"))
-			if err != nil {
-				return err
-			}
-		} else {
-			return err
-		}
-	} else {
-		if err := json.Unmarshal(raw, &data); err != nil {
-			return err
+// del 删除容器 id 的 ifName 接口的 IP 分配记录，返回被删除的 IP 与分配记录
+func (d *data) del(id, ifName string) (net.IP, Allocation) {
+	for ip, info := range d.IPs {
+		if info.Match(id, ifName) {
+			delete(d.IPs, ip)
+			d.Released[ip] = time.Now()
+			return net.ParseIP(ip), info
 		}
 	}
+	return nil, Allocation{}
+}
 
-	if data.IPs == nil {
-		data.IPs = make(map[string]containerNetInfo)
+// delIP 删除 ip 的分配记录，返回被删除的分配记录以及记录是否存在
+func (d *data) delIP(ip net.IP) (Allocation, bool) {
+	info, ok := d.IPs[ip.String()]
+	if !ok {
+		return Allocation{}, false
 	}
+	delete(d.IPs, ip.String())
+	d.Released[ip.String()] = time.Now()
+	return info, true
+}
 
-	s.data = data
+// reserve 在 expires 之前为 Pod 的 ifName 接口保留 IP
+func (d *data) reserve(ip net.IP, pod, ifName string, expires time.Time) error {
+	if len(ip) == 0 {
+		return fmt.Errorf("invalid IP")
+	}
+
+	d.Reserved[ip.String()] = reservation{
+		Pod:     pod,
+		IfName:  ifName,
+		Expires: expires,
+	}
 	return nil
 }
 
-// GetIPById 根据容器 ID 查找对应的 IP 地址
-func (s *Store) GetIPById(id string) (net.IP, bool) {
-	for ip, info := range s.data.IPs {
-		if info.ContainerID == id {
+// purgeReservations 删除已经过期的保留记录
+func (d *data) purgeReservations(now time.Time) {
+	for ip, r := range d.Reserved {
+		if !now.Before(r.Expires) {
+			delete(d.Reserved, ip)
+		}
+	}
+}
+
+// state 保存从后端加载到内存中的数据，实现各个后端通用的查询方法
+type state struct {
+	data *data
+}
+
+// GetIP 根据容器 ID 与接口名称查找对应的 IP 地址
+func (st *state) GetIP(id, ifName string) (net.IP, bool) {
+	for ip, info := range st.data.IPs {
+		if info.Match(id, ifName) {
 			return net.ParseIP(ip), true
 		}
 	}
@@ -132,47 +263,56 @@ func (s *Store) GetIPById(id string) (net.IP, bool) {
 }
 
 // Last 返回最近分配的 IP 地址
-func (s *Store) Last() net.IP {
-	return net.ParseIP(s.data.Last)
+func (st *state) Last() net.IP {
+	return net.ParseIP(st.data.Last)
 }
 
-// Save 将 s.data 保存到 json 文件中
-func (s *Store) Save() error {
-	raw, err := json.Marshal(s.data)
-	if err != nil {
-		return err
-	}
-
-	return os.WriteFile(s.dataFile, raw, 0644)
+// Contain 检查某个 IP 是否已经被分配
+func (st *state) Contain(ip net.IP) bool {
+	_, ok := st.data.IPs[ip.String()]
+	return ok
 }
 
-// Add 添加一个新的 IP 分配记录
-func (s *Store) Add(ip net.IP, id, ifName string) error {
-	if len(ip) == 0 {
-		return fmt.Errorf("invalid IP")
+// Iterate 遍历所有分配记录
+func (st *state) Iterate(fn func(ip net.IP, alloc Allocation) bool) {
+	for ip, alloc := range st.data.IPs {
+		if !fn(net.ParseIP(ip), alloc) {
+			return
+		}
 	}
+}
 
-	s.data.IPs[ip.String()] = containerNetInfo{
-		ContainerID: id,
-		IfName:      ifName,
+// GetReservedIP 查找仍在保留期内、为 Pod 的 ifName 接口保留的 IP
+func (st *state) GetReservedIP(pod, ifName string) (net.IP, bool) {
+	now := time.Now()
+	for ip, r := range st.data.Reserved {
+		if r.match(pod, ifName) && now.Before(r.Expires) {
+			return net.ParseIP(ip), true
+		}
 	}
-	s.data.Last = ip.String()
-	return s.Save()
+	return nil, false
 }
 
-// Del 根据容器 ID 删除一个 IP 分配记录
-func (s *Store) Del(id string) error {
-	for ip, info := range s.data.IPs {
-		if info.ContainerID == id {
-			delete(s.data.IPs, ip)
-			return s.Save()
-		}
+// ReservedBy 返回保留该 IP 的 Pod 与接口，IP 未被保留或保留已过期时返回 false
+func (st *state) ReservedBy(ip net.IP) (pod, ifName string, ok bool) {
+	r, ok := st.data.Reserved[ip.String()]
+	if !ok || !time.Now().Before(r.Expires) {
+		return "", "", false
 	}
-	return nil
+	return r.Pod, r.IfName, true
 }
 
-// Contain 检查某个 IP 是否已经被分配
-func (s *Store) Contain(ip net.IP) bool {
-	_, ok := s.data.IPs[ip.String()]
-	return ok
+// ReleasedAt 返回 IP 最近一次被释放的时间
+func (st *state) ReleasedAt(ip net.IP) (time.Time, bool) {
+	t, ok := st.data.Released[ip.String()]
+	return t, ok
+}
+
+// PurgeReleased 删除 before 之前的释放记录，修改会在下一次持久化时写入后端
+func (st *state) PurgeReleased(before time.Time) {
+	for ip, t := range st.data.Released {
+		if t.Before(before) {
+			delete(st.data.Released, ip)
+		}
+	}
 }